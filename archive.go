@@ -0,0 +1,88 @@
+package analytics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// archive the flushed events to ~/<dir>/archive/<timestamp>.json.gz,
+// keeping the last Archive batches. Batches are encrypted into
+// <timestamp>.json.gz.enc when there's an encryption key.
+func (a *Analytics) archive(events []*Event) error {
+	if a.Archive <= 0 || a.Memory {
+		return nil
+	}
+
+	dir := filepath.Join(a.stateRoot, "archive")
+	if err := os.MkdirAll(dir, a.DirMode); err != nil {
+		return errors.Wrap(err, "creating archive")
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return errors.Wrap(err, "writing event")
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return errors.Wrap(err, "compressing")
+	}
+
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + ".json.gz"
+	data := buf.Bytes()
+
+	if a.aead != nil {
+		sealed, err := seal(a.aead, data)
+		if err != nil {
+			return err
+		}
+		name += ".enc"
+		data = sealed
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, a.FileMode); err != nil {
+		return errors.Wrap(err, "writing batch")
+	}
+
+	return pruneArchive(dir, a.Archive)
+}
+
+// pruneArchive removes all but the newest `keep` batches.
+func pruneArchive(dir string, keep int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var batches []string
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".json.gz") {
+			batches = append(batches, entry.Name())
+		}
+	}
+
+	// names sort oldest first
+	sort.Strings(batches)
+
+	for len(batches) > keep {
+		if err := os.Remove(filepath.Join(dir, batches[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		batches = batches[1:]
+	}
+
+	return nil
+}
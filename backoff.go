@@ -0,0 +1,63 @@
+package analytics
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff between retries of records that failed to send, using
+// exponential backoff with full jitter.
+type Backoff struct {
+	MaxAttempts int           // MaxAttempts including the first. Defaults to 3
+	MaxElapsed  time.Duration // MaxElapsed time across all attempts (optional)
+	Min         time.Duration // Min delay before the first retry. Defaults to 100ms
+	Max         time.Duration // Max delay between retries. Defaults to 5s
+}
+
+// next returns the delay before the next attempt, or false if
+// we've run out of attempts or would exceed the time budget.
+func (b Backoff) next(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	maxAttempts := b.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	min := b.Min
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	max := b.Max
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+
+	if attempt >= maxAttempts {
+		return 0, false
+	}
+
+	// cap the exponent so the shift can't overflow
+	ceiling := max
+	if attempt < 32 && min<<uint(attempt-1) < max {
+		ceiling = min << uint(attempt-1)
+	}
+	delay := time.Duration(rand.Int63n(int64(ceiling) + 1))
+
+	if b.MaxElapsed > 0 && elapsed+delay > b.MaxElapsed {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// sleep for d or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,102 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBreakerOpen is returned by Flush while the breaker is open after
+// too many failed flushes, so offline users don't wait on the network.
+var ErrBreakerOpen = errors.New("analytics: breaker open")
+
+// breaker state kept in ~/<dir>/breaker, so it survives between commands.
+type breaker struct {
+	Failures int       `json:"failures"`
+	Opened   time.Time `json:"opened,omitempty"`
+}
+
+// open reports whether the breaker is open and the cool-down hasn't
+// elapsed yet.
+func (b *breaker) open(threshold int, cooldown time.Duration) bool {
+	return b.Failures >= threshold && time.Since(b.Opened) < cooldown
+}
+
+// breakerOpen reports whether flushes should be skipped.
+func (a *Analytics) breakerOpen() bool {
+	if a.Breaker <= 0 {
+		return false
+	}
+
+	b, err := a.readBreaker()
+	if err != nil {
+		a.Log.WithError(err).Debug("error reading breaker")
+		return false
+	}
+
+	return b.open(a.Breaker, a.Cooldown)
+}
+
+// trip counts a failed flush, opening the breaker once there have been
+// Breaker failures in a row. A successful flush closes it again. Flushes
+// whose context was cancelled or timed out aren't counted, since they
+// gave up rather than the sink failing.
+func (a *Analytics) trip(ctx context.Context, err error) error {
+	if a.Breaker <= 0 {
+		return nil
+	}
+
+	if err == nil {
+		if err := a.removeFile("breaker"); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "removing breaker")
+		}
+		return nil
+	}
+
+	if cause := errors.Cause(err); ctx.Err() != nil || cause == context.Canceled || cause == context.DeadlineExceeded {
+		return nil
+	}
+
+	b, err := a.readBreaker()
+	if err != nil {
+		return err
+	}
+
+	b.Failures++
+	if b.Failures >= a.Breaker {
+		a.Log.WithField("failures", b.Failures).Warn("opening breaker, skipping flushes until the cool-down")
+		b.Opened = time.Now()
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	if err := a.writeFile("breaker", data); err != nil {
+		return errors.Wrap(err, "saving breaker")
+	}
+
+	return nil
+}
+
+// readBreaker reads ~/<dir>/breaker, which is closed if it doesn't exist.
+func (a *Analytics) readBreaker() (*breaker, error) {
+	var b breaker
+
+	data, err := a.readFile("breaker")
+	if os.IsNotExist(err) {
+		return &b, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading breaker")
+	}
+
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, errors.Wrap(err, "decoding breaker")
+	}
+
+	return &b, nil
+}
@@ -0,0 +1,209 @@
+package analytics
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// key identifies the event in the checkpoint and attempts: its ID, or
+// its Seq or offset in the queue for events queued without an ID.
+func (e *Event) key() string {
+	switch {
+	case e.ID != "":
+		return e.ID
+	case e.Seq > 0:
+		return "seq:" + strconv.FormatUint(e.Seq, 10)
+	case e.offset > 0:
+		return "offset:" + strconv.Itoa(e.offset-1)
+	default:
+		return ""
+	}
+}
+
+// partial returns the partial error within err, if any.
+func partial(err error) *PartialError {
+	for err != nil {
+		if pe, ok := err.(*PartialError); ok {
+			return pe
+		}
+
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return nil
+		}
+		err = cause.Cause()
+	}
+
+	return nil
+}
+
+// accepted returns the keys of the events the sink accepted before
+// failing with a partial error.
+func accepted(events []*Event, err error) (ids []string) {
+	pe := partial(err)
+	if pe == nil {
+		return nil
+	}
+
+	failed := map[string]bool{}
+	for _, event := range pe.Failed {
+		failed[event.key()] = true
+	}
+
+	for _, event := range events {
+		if !failed[event.key()] {
+			ids = append(ids, event.key())
+		}
+	}
+
+	return ids
+}
+
+// rejected returns the events that weren't accepted.
+func rejected(events []*Event, accepted []string) (v []*Event) {
+	ok := map[string]bool{}
+	for _, id := range accepted {
+		ok[id] = true
+	}
+
+	for _, event := range events {
+		if !ok[event.key()] {
+			v = append(v, event)
+		}
+	}
+
+	return v
+}
+
+// checkpoint saves the keys of the events that were sent before the
+// flush failed to ~/<dir>/checkpoint, so they aren't sent again.
+func (a *Analytics) checkpoint(sent []string) error {
+	if len(sent) == 0 {
+		return nil
+	}
+
+	ids, err := a.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range sent {
+		if id != "" {
+			ids[id] = true
+		}
+	}
+
+	return a.saveCheckpoint(ids)
+}
+
+// saveCheckpoint writes the keys to ~/<dir>/checkpoint, removing it
+// once there aren't any.
+func (a *Analytics) saveCheckpoint(ids map[string]bool) error {
+	if len(ids) == 0 {
+		return a.clearCheckpoint()
+	}
+
+	var buf bytes.Buffer
+	for id := range ids {
+		buf.WriteString(id + "\n")
+	}
+
+	return a.writeFile("checkpoint", buf.Bytes())
+}
+
+// readCheckpoint reads the keys of the events already sent.
+func (a *Analytics) readCheckpoint() (map[string]bool, error) {
+	sent := map[string]bool{}
+
+	b, err := a.readFile("checkpoint")
+	if os.IsNotExist(err) {
+		return sent, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading checkpoint")
+	}
+
+	for _, id := range strings.Fields(string(b)) {
+		sent[id] = true
+	}
+
+	return sent, nil
+}
+
+// unsent returns the events that haven't been sent yet.
+func (a *Analytics) unsent(events []*Event) ([]*Event, error) {
+	sent, err := a.readCheckpoint()
+	if err != nil || len(sent) == 0 {
+		return events, err
+	}
+
+	var unsent []*Event
+	for _, event := range events {
+		if !sent[event.key()] {
+			unsent = append(unsent, event)
+		}
+	}
+
+	return unsent, nil
+}
+
+// dequeued moves the offset keys in the checkpoint and attempts up
+// the queue once `n` events are removed from its head, dropping those
+// of the removed events.
+func (a *Analytics) dequeued(n int) error {
+	sent, err := a.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	moved := map[string]bool{}
+	for key := range sent {
+		if key, ok := shift(key, n); ok {
+			moved[key] = true
+		}
+	}
+
+	if err := a.saveCheckpoint(moved); err != nil {
+		return errors.Wrap(err, "saving checkpoint")
+	}
+
+	attempts, err := a.readAttempts()
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for key, count := range attempts {
+		if key, ok := shift(key, n); ok {
+			counts[key] = count
+		}
+	}
+
+	return a.saveAttempts(counts)
+}
+
+// shift the offset key up `n` events, returning false if its event was
+// removed. Other keys are returned as is.
+func shift(key string, n int) (string, bool) {
+	if !strings.HasPrefix(key, "offset:") {
+		return key, true
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(key, "offset:"))
+	if err != nil || offset < n {
+		return "", false
+	}
+
+	return "offset:" + strconv.Itoa(offset-n), true
+}
+
+// clearCheckpoint removes the checkpoint once its events are removed.
+func (a *Analytics) clearCheckpoint() error {
+	if err := a.removeFile("checkpoint"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
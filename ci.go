@@ -0,0 +1,54 @@
+package analytics
+
+import (
+	"os"
+	"strconv"
+)
+
+// CIPolicy decides what happens to events tracked in CI.
+type CIPolicy int
+
+// CI policies
+const (
+	CITag      CIPolicy = iota // Tag events with `ci: true`
+	CISuppress                 // Don't track anything
+	CIIgnore                   // Don't detect CI at all
+)
+
+// environment variables set by common CI providers
+var ciEnv = []string{
+	"CI",
+	"CONTINUOUS_INTEGRATION",
+	"BUILD_NUMBER",
+	"GITHUB_ACTIONS",
+	"GITLAB_CI",
+	"CIRCLECI",
+	"TRAVIS",
+	"BUILDKITE",
+	"JENKINS_URL",
+	"TEAMCITY_VERSION",
+	"TF_BUILD",
+	"BITBUCKET_BUILD_NUMBER",
+	"CODEBUILD_BUILD_ID",
+	"DRONE",
+	"APPVEYOR",
+}
+
+// isCI returns true if we're running in a CI environment.
+func isCI() bool {
+	for _, key := range ciEnv {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+
+		// allow CI=false and friends
+		if b, err := strconv.ParseBool(v); err == nil && !b {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
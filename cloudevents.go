@@ -0,0 +1,45 @@
+package analytics
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// CloudEvents serializes events as CloudEvents 1.0 JSON envelopes, for
+// EventBridge and other CloudEvents consumers. Set it as the Config's
+// Marshaler.
+type CloudEvents struct {
+	Source string // Source of the events, e.g. the app's URL or name
+}
+
+// cloudEvent envelope in the JSON format.
+type cloudEvent struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Time            string `json:"time,omitempty"`
+	DataContentType string `json:"datacontenttype"`
+	Seq             uint64 `json:"seq,omitempty"`
+	Data            Body   `json:"data"`
+}
+
+// Marshal the event into an envelope, with the body as its data.
+func (c *CloudEvents) Marshal(event *Event) ([]byte, error) {
+	data, err := json.Marshal(&cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.ID,
+		Source:          c.Source,
+		Type:            event.Event,
+		Time:            isoTimestamp(event.Timestamp),
+		DataContentType: "application/json",
+		Seq:             event.Seq,
+		Data:            event.Body,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	return data, nil
+}
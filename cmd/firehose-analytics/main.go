@@ -0,0 +1,126 @@
+// Command firehose-analytics inspects and manages the queue of events
+// an application keeps on disk with the firehose-analytics package.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	analytics "github.com/matthewmueller/firehose-analytics"
+)
+
+const usage = `Usage: firehose-analytics [flags] <command>
+
+Commands:
+  status   show the queue, the last flush and whether tracking is enabled
+  list     print the queued events
+  flush    send the queued events to Firehose
+  enable   opt back in to tracking
+  errors   only track errors
+  disable  opt out of tracking
+  purge    clear the queued events
+  erase    delete everything kept about the user, starting afresh
+
+Flags:
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// run the command in `args`, writing its output to `w`.
+func run(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("firehose-analytics", flag.ContinueOnError)
+	stream := fs.String("stream", "", "stream the application publishes to")
+	dir := fs.String("dir", "", "dir the application uses, defaults to the stream")
+	path := fs.String("path", "", "path to the directory, instead of -dir")
+	region := fs.String("region", "", "AWS region of the stream, for flush")
+	format := fs.String("format", "table", "format for list, table or json")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for flush")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 || *stream == "" {
+		fs.Usage()
+		return fmt.Errorf("expected -stream and a command")
+	}
+
+	config := &analytics.Config{
+		Stream: *stream,
+		Dir:    *dir,
+		Path:   *path,
+	}
+
+	command := fs.Arg(0)
+	if command == "flush" {
+		sess, err := session.NewSession(aws.NewConfig().WithRegion(*region))
+		if err != nil {
+			return err
+		}
+		config.Session = sess
+	}
+
+	a := analytics.NewFromConfig(config)
+	defer a.Close()
+
+	switch command {
+	case "status":
+		return status(w, a)
+	case "list":
+		return a.Dump(w, *format)
+	case "flush":
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		return a.FlushContext(ctx)
+	case "enable":
+		return a.Enable()
+	case "errors":
+		return a.SetConsent(analytics.ConsentErrors)
+	case "disable":
+		return a.Disable()
+	case "purge":
+		return a.Purge()
+	case "erase":
+		return a.Erase()
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// status prints the stats.
+func status(w io.Writer, a *analytics.Analytics) error {
+	stats, err := a.Stats()
+	if err != nil {
+		return err
+	}
+
+	last := "never"
+	if !stats.LastFlush.IsZero() {
+		last = stats.LastFlush.Format(time.RFC3339)
+	}
+
+	fmt.Fprintf(w, "enabled:    %t\n", stats.Enabled)
+	fmt.Fprintf(w, "consent:    %s\n", stats.Consent)
+	fmt.Fprintf(w, "lifecycle:  %s\n", stats.Lifecycle)
+	fmt.Fprintf(w, "events:     %d (%d bytes)\n", stats.Events, stats.Bytes)
+	fmt.Fprintf(w, "last flush: %s\n", last)
+	fmt.Fprintf(w, "config:     %s\n", stats.Dir)
+	fmt.Fprintf(w, "state:      %s\n", stats.StateDir)
+	return nil
+}
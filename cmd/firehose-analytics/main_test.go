@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	analytics "github.com/matthewmueller/firehose-analytics"
+)
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir+"/config")
+	t.Setenv("XDG_STATE_HOME", dir+"/state")
+
+	a := analytics.New("app")
+	a.Track("cool", nil)
+	a.Close()
+
+	cmd := func(args ...string) string {
+		var buf bytes.Buffer
+		if err := run(append([]string{"-stream", "app"}, args...), &buf); err != nil {
+			t.Fatalf("%s: %s", args, err)
+		}
+		return buf.String()
+	}
+
+	if out := cmd("status"); !strings.Contains(out, "events:     1") || !strings.Contains(out, "enabled:    true") {
+		t.Fatalf("unexpected status %s", out)
+	}
+
+	if out := cmd("-format", "json", "list"); !strings.Contains(out, `"event": "cool"`) {
+		t.Fatalf("unexpected list %s", out)
+	}
+
+	cmd("purge")
+	cmd("disable")
+	if out := cmd("status"); !strings.Contains(out, "events:     0") || !strings.Contains(out, "enabled:    false") {
+		t.Fatalf("unexpected status %s", out)
+	}
+
+	cmd("enable")
+	if out := cmd("status"); !strings.Contains(out, "enabled:    true") {
+		t.Fatalf("unexpected status %s", out)
+	}
+
+	var buf bytes.Buffer
+	if err := run([]string{"-stream", "app", "nope"}, &buf); err == nil {
+		t.Fatal("expected an unknown command")
+	}
+	if err := run([]string{"status"}, &buf); err == nil {
+		t.Fatal("expected a missing stream")
+	}
+}
@@ -0,0 +1,137 @@
+package analytics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// compressed returns true if the file at `path` is gzipped.
+func compressed(path string) bool {
+	return strings.HasSuffix(path, ".gz")
+}
+
+// openEvents opens the file at `path`, decompressing it if needed.
+func openEvents(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !compressed(path) {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "decompressing")
+	}
+
+	return &gzipFile{zr, f}, nil
+}
+
+// gzipFile closes both the gzip reader and the file.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+// Close the reader and file.
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// gzipRecord compresses the data of a Firehose record. Unlike a JSON
+// record, it starts with gzip's magic number, 0x1f 0x8b.
+func gzipRecord(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+
+	if _, err := zw.Write(data); err != nil {
+		return nil, errors.Wrap(err, "compressing")
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "compressing")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeEvents atomically writes `data` to the file at `path` with
+// `mode`, compressing it if needed.
+func writeEvents(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "events")
+	if err != nil {
+		return errors.Wrap(err, "creating file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	var w io.WriteCloser = tmp
+	if compressed(path) {
+		w = gzip.NewWriter(tmp)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing events")
+	}
+
+	if compressed(path) {
+		if err := w.Close(); err != nil {
+			tmp.Close()
+			return errors.Wrap(err, "compressing")
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// compressSegments gzips the uncompressed segments. The flush lock
+// must be held, so the segments aren't removed while compressing.
+func (s *fileStore) compressSegments() error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if compressed(segment) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(segment)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := writeEvents(segment+".gz", data, s.mode); err != nil {
+			return err
+		}
+
+		if err := os.Remove(segment); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
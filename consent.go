@@ -0,0 +1,146 @@
+package analytics
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Consent the user has given, from tracking nothing to everything.
+// Events are tracked when their tier is at or below the consent.
+type Consent int
+
+// Consent tiers
+const (
+	ConsentOff    Consent = iota // Don't track anything
+	ConsentErrors                // Only track errors, see TrackTier
+	ConsentFull                  // Track everything
+)
+
+// String returns the consent as it's saved in ~/<dir>/consent.
+func (c Consent) String() string {
+	switch c {
+	case ConsentOff:
+		return "off"
+	case ConsentErrors:
+		return "errors"
+	case ConsentFull:
+		return "full"
+	default:
+		return fmt.Sprintf("Consent(%d)", int(c))
+	}
+}
+
+// ParseConsent parses "off", "errors" or "full".
+func ParseConsent(s string) (Consent, error) {
+	switch strings.TrimSpace(s) {
+	case "off":
+		return ConsentOff, nil
+	case "errors":
+		return ConsentErrors, nil
+	case "full":
+		return ConsentFull, nil
+	default:
+		return ConsentOff, fmt.Errorf("invalid consent %q", s)
+	}
+}
+
+// Consent returns the user's consent. The CI policy, DO_NOT_TRACK and
+// the EnvVar take precedence over ~/<dir>/consent, which defaults to
+// full unless there's a ~/<dir>/disable from an older version.
+func (a *Analytics) Consent() (Consent, error) {
+	if enabled, ok := a.envEnabled(); ok {
+		if enabled {
+			return ConsentFull, nil
+		}
+		return ConsentOff, nil
+	}
+
+	b, err := a.readFile("consent")
+	if err == nil {
+		return ParseConsent(string(b))
+	} else if !os.IsNotExist(err) {
+		return ConsentOff, err
+	}
+
+	_, err = a.modTime("disable")
+	if os.IsNotExist(err) {
+		return ConsentFull, nil
+	}
+
+	return ConsentOff, err
+}
+
+// SetConsent sets the consent for this instance and persists it to
+// ~/<dir>/consent. The environment still wins.
+func (a *Analytics) SetConsent(c Consent) error {
+	if err := a.removeFile("disable"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if c == ConsentFull {
+		if err := a.removeFile("consent"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := a.writeFile("consent", []byte(c.String())); err != nil {
+		return err
+	}
+
+	if c != ConsentOff {
+		if enabled, ok := a.envEnabled(); ok && !enabled {
+			return nil
+		}
+	}
+
+	a.apply(c)
+	return nil
+}
+
+// apply consent `c`, disabling the client or opening it unless it's
+// closed. The consent and lifecycle are updated together under the lock.
+func (a *Analytics) apply(c Consent) {
+	a.mu.Lock()
+	a.consent = c
+	lifecycle := a.lifecycle
+	if c == ConsentOff && lifecycle == LifecycleOpen {
+		a.lifecycle = LifecycleDisabled
+	}
+	a.mu.Unlock()
+
+	if c != ConsentOff && lifecycle != LifecycleClosed {
+		a.open()
+	}
+}
+
+// TrackTier tracks event `name` if the user consented to `tier`,
+// e.g. ConsentErrors for crashes. Track uses ConsentFull.
+func (a *Analytics) TrackTier(tier Consent, name string, body Body) error {
+	if ok, err := a.admits(tier); err != nil {
+		return a.report(err)
+	} else if !ok {
+		return nil
+	}
+
+	return a.report(a.track(a.event(name, body), a.write))
+}
+
+// admits returns true if we're active and the user consented to `tier`,
+// or an error if the client is broken or closed. Both are checked at
+// once, so closing in between can't drop the event silently.
+func (a *Analytics) admits(tier Consent) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.usable(); err != nil {
+		return false, err
+	}
+
+	return a.lifecycle == LifecycleOpen && tier != ConsentOff && tier <= a.consent, nil
+}
+
+// permits returns true if we're active and the user consented to `tier`.
+func (a *Analytics) permits(tier Consent) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lifecycle == LifecycleOpen && tier != ConsentOff && tier <= a.consent
+}
@@ -0,0 +1,175 @@
+package analytics
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// deadLetters kept in ~/<dir>/deadletter.
+type deadLetters struct {
+	Events []*Event `json:"events"`
+}
+
+// attempt counts another failed attempt to send the events, moving those
+// that have failed MaxAttempts times to ~/<dir>/deadletter. Returns the
+// keys of the dead-lettered events, which are checkpointed so they're
+// skipped and removed with the rest of their batch.
+func (a *Analytics) attempt(failed []*Event) ([]string, error) {
+	if a.MaxAttempts <= 0 || len(failed) == 0 {
+		return nil, nil
+	}
+
+	attempts, err := a.readAttempts()
+	if err != nil {
+		return nil, err
+	}
+
+	var dead []*Event
+	var ids []string
+	for _, event := range failed {
+		key := event.key()
+		attempts[key]++
+		if attempts[key] >= a.MaxAttempts {
+			dead = append(dead, event)
+			ids = append(ids, key)
+			delete(attempts, key)
+		}
+	}
+
+	if len(dead) > 0 {
+		a.Log.WithField("events", len(dead)).Warn("moving events that keep failing to the dead letters")
+		if err := a.appendDeadLetters(dead); err != nil {
+			return nil, err
+		}
+		a.Metrics.Dropped(len(dead))
+	}
+
+	if err := a.saveAttempts(attempts); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// readAttempts reads the failed attempts by event key.
+func (a *Analytics) readAttempts() (map[string]int, error) {
+	attempts := map[string]int{}
+
+	b, err := a.readFile("attempts")
+	if os.IsNotExist(err) {
+		return attempts, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading attempts")
+	}
+
+	if err := json.Unmarshal(b, &attempts); err != nil {
+		return nil, errors.Wrap(err, "decoding attempts")
+	}
+
+	return attempts, nil
+}
+
+// saveAttempts saves the failed attempts, removing the file once
+// there aren't any.
+func (a *Analytics) saveAttempts(attempts map[string]int) error {
+	if len(attempts) == 0 {
+		return a.clearAttempts()
+	}
+
+	b, err := json.Marshal(attempts)
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	return a.writeFile("attempts", b)
+}
+
+// clearAttempts once a flush succeeds.
+func (a *Analytics) clearAttempts() error {
+	if err := a.removeFile("attempts"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeadLetter returns the events that were moved aside after failing
+// to send MaxAttempts times.
+func (a *Analytics) DeadLetter() ([]*Event, error) {
+	b, err := a.readSecret("deadletter")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading dead letters")
+	}
+
+	var d deadLetters
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrap(err, "decoding dead letters")
+	}
+
+	return d.Events, nil
+}
+
+// appendDeadLetters adds the events to ~/<dir>/deadletter.
+func (a *Analytics) appendDeadLetters(events []*Event) error {
+	existing, err := a.DeadLetter()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&deadLetters{Events: append(existing, events...)})
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	return a.writeSecret("deadletter", b)
+}
+
+// RetryDeadLetter requeues the dead letters so the next flush tries
+// them again. Events still in the queue are no longer skipped, rather
+// than being queued twice.
+func (a *Analytics) RetryDeadLetter() error {
+	if a.store == nil {
+		return errors.New("no store")
+	}
+
+	events, err := a.DeadLetter()
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	sent, err := a.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	var requeue []*Event
+	for _, event := range events {
+		if sent[event.key()] {
+			delete(sent, event.key())
+			continue
+		}
+		requeue = append(requeue, event)
+	}
+
+	if err := a.saveCheckpoint(sent); err != nil {
+		return errors.Wrap(err, "saving checkpoint")
+	}
+
+	if len(requeue) > 0 {
+		a.mu.Lock()
+		err := a.store.Append(requeue...)
+		a.mu.Unlock()
+		if err != nil {
+			return errors.Wrap(err, "requeueing events")
+		}
+	}
+
+	if err := a.removeFile("deadletter"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Dump writes the pending events to w, so users can see exactly what's
+// queued on their machine. The format is "json" for pretty-printed JSON,
+// the default, or "table" for one event per row.
+func (a *Analytics) Dump(w io.Writer, format string) error {
+	events, err := a.Events()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return errors.Wrap(err, "writing event")
+			}
+		}
+
+		return nil
+	case "table":
+		return dumpTable(w, events)
+	default:
+		return fmt.Errorf("unknown format %q, expected json or table", format)
+	}
+}
+
+// dumpTable writes the events as an aligned table.
+func dumpTable(w io.Writer, events []*Event) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEQ\tTIME\tEVENT\tBODY")
+
+	for _, event := range events {
+		body, err := json.Marshal(event.Body)
+		if err != nil {
+			return errors.Wrap(err, "marshal error")
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", event.Seq, event.Timestamp, event.Event, body)
+	}
+
+	return tw.Flush()
+}
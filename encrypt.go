@@ -0,0 +1,77 @@
+package analytics
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// newAEAD creates an AES-GCM cipher from a 16, 24 or 32 byte key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encryption key")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// random generates the nonces.
+var random io.Reader = rand.Reader
+
+// seal encrypts `data`, prefixing it with a random nonce.
+func seal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// unseal decrypts data encrypted with seal.
+func unseal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// readSecret reads ~/<dir>/<name>, decrypting it if there's
+// an encryption key. Files from before there was a key are
+// read as-is, but only if they don't decrypt, since a nonce
+// can start with a brace too.
+func (a *Analytics) readSecret(name string) ([]byte, error) {
+	b, err := a.readFile(name)
+	if err != nil || a.aead == nil {
+		return b, err
+	}
+
+	data, err := unseal(a.aead, b)
+	if err != nil && bytes.HasPrefix(b, []byte("{")) {
+		return b, nil
+	}
+
+	return data, err
+}
+
+// writeSecret writes ~/<dir>/<name>, encrypting it if there's
+// an encryption key.
+func (a *Analytics) writeSecret(name string, data []byte) error {
+	if a.aead == nil {
+		return a.writeFile(name, data)
+	}
+
+	sealed, err := seal(a.aead, data)
+	if err != nil {
+		return err
+	}
+
+	return a.writeFile(name, sealed)
+}
@@ -0,0 +1,85 @@
+package analytics
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// environment returns the fields attached to every event when
+// Config.Enrich is set.
+func environment(ci bool) Body {
+	return Body{
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"go_version": runtime.Version(),
+		"terminal":   isTerminal(os.Stdout),
+		"ci":         ci,
+	}
+}
+
+// isTerminal returns true if `f` is a terminal, rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// locale returns the user's locale from the environment, e.g. en_US,
+// dropping the encoding and modifier.
+func locale() string {
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		v := os.Getenv(key)
+		if v == "" || v == "C" || v == "POSIX" {
+			continue
+		}
+
+		if i := strings.IndexAny(v, ".@"); i >= 0 {
+			v = v[:i]
+		}
+
+		return v
+	}
+
+	return ""
+}
+
+// timeOfDay buckets the local hour into night, morning, afternoon or evening.
+func timeOfDay(t time.Time) string {
+	switch h := t.Hour(); {
+	case h < 6:
+		return "night"
+	case h < 12:
+		return "morning"
+	case h < 18:
+		return "afternoon"
+	default:
+		return "evening"
+	}
+}
+
+// attach the locale, timezone offset and time of day to the body.
+func (a *Analytics) attachLocale(body Body, t time.Time) {
+	if !a.Locale {
+		return
+	}
+
+	t = t.Local()
+	_, offset := t.Zone()
+
+	if l := locale(); l != "" && body["locale"] == nil {
+		body.Set("locale", l)
+	}
+
+	if body["tz_offset"] == nil {
+		body.Set("tz_offset", offset/60)
+	}
+
+	if body["time_of_day"] == nil {
+		body.Set("time_of_day", timeOfDay(t))
+	}
+}
@@ -0,0 +1,63 @@
+package analytics
+
+import (
+	"os"
+	"path/filepath"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/pkg/errors"
+)
+
+// erased files, everything but the consent
+var erased = []string{
+	"id",
+	"traits",
+	"group",
+	"last_flush",
+	"seq",
+	"metrics",
+	"checkpoint",
+	"corrupt",
+	"attempts",
+	"deadletter",
+}
+
+// Erase removes everything kept locally about the user: the id, traits,
+// group, pending and archived events and the last flush, for "delete my
+// data" commands. A fresh anonymous ID is used from then on, while the
+// user's consent is kept.
+func (a *Analytics) Erase() error {
+	if err := a.purge(false); err != nil {
+		return err
+	}
+
+	for _, name := range erased {
+		if err := a.removeFile(name); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing %s", name)
+		}
+	}
+
+	if !a.Memory {
+		if err := os.RemoveAll(filepath.Join(a.stateRoot, "archive")); err != nil {
+			return errors.Wrap(err, "removing archive")
+		}
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return errors.Wrap(err, "generating id")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// saved by create on the next write
+	a.userID = id
+	a.identity = nil
+	a.group = nil
+	a.seq = 0
+	a.seqEnd = 0
+	a.metrics = metrics{}
+	a.created = false
+	return nil
+}
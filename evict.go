@@ -0,0 +1,232 @@
+package analytics
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// EvictionPolicy decides which events are dropped once the queue is full.
+type EvictionPolicy int
+
+// Eviction policies
+const (
+	EvictOldest EvictionPolicy = iota // Remove the oldest events to make room
+	EvictNewest                       // Drop new events until there's room
+)
+
+// lineCount caches the number of events in a file.
+type lineCount struct {
+	size    int64
+	modTime time.Time
+	n       int
+}
+
+// makeRoom applies the eviction policy so `size` bytes holding `n` new
+// events fit within the queue limits. Returns false if the new events
+// should be dropped.
+func (s *fileStore) makeRoom(size int64, n int) (bool, error) {
+	if s.maxBytes <= 0 && s.maxEvents <= 0 {
+		return true, nil
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return false, err
+	}
+
+	usedBytes := int64(len(s.buf))
+	usedEvents := s.buffered
+
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		usedBytes += info.Size()
+
+		if s.maxEvents > 0 {
+			count, err := s.count(path, info)
+			if err != nil {
+				return false, err
+			}
+			usedEvents += count
+		}
+	}
+
+	var overBytes int64
+	var overEvents int
+
+	if s.maxBytes > 0 {
+		overBytes = usedBytes + size - s.maxBytes
+	}
+
+	if s.maxEvents > 0 {
+		overEvents = usedEvents + n - s.maxEvents
+	}
+
+	if overBytes <= 0 && overEvents <= 0 {
+		return true, nil
+	}
+
+	ctx := s.log.WithFields(log.Fields{
+		"events":     n,
+		"max_bytes":  s.maxBytes,
+		"max_events": s.maxEvents,
+	})
+
+	// the new events would never fit
+	if (s.maxBytes > 0 && size > s.maxBytes) || (s.maxEvents > 0 && n > s.maxEvents) {
+		ctx.Warn("dropping events larger than the queue")
+		s.metrics.Dropped(n)
+		return false, nil
+	}
+
+	if s.evict == EvictNewest {
+		ctx.Warn("queue full, dropping new events")
+		s.metrics.Dropped(n)
+		return false, nil
+	}
+
+	// a flush that's sending will make room, so don't wait on it
+	ok, err := s.flush.tryLock()
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return true, nil
+	}
+	defer s.flush.unlock()
+
+	evict, err := s.oldest(files, overBytes, overEvents)
+	if err != nil {
+		return false, err
+	}
+
+	ctx.WithField("evicted", evict).Warn("queue full, evicting oldest events")
+	if err := s.remove(evict); err != nil {
+		return false, err
+	}
+
+	s.metrics.Dropped(evict)
+	return true, nil
+}
+
+// files returns the paths to the segments and events file, oldest first.
+func (s *fileStore) files() ([]string, error) {
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(segments, s.path), nil
+}
+
+// count the events in the file at `path`, caching the count until
+// the file changes. Corrupt lines aren't counted.
+func (s *fileStore) count(path string, info os.FileInfo) (int, error) {
+	if c, ok := s.counts[path]; ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.n, nil
+	}
+
+	f, err := openEvents(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	r := bufio.NewReader(f)
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// long lines are rare, read the rest of them
+			rest, err2 := r.ReadBytes('\n')
+			line, err = append(append([]byte(nil), line...), rest...), err2
+		}
+
+		if s.intact(line) {
+			n++
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	s.counts[path] = &lineCount{size: info.Size(), modTime: info.ModTime(), n: n}
+	return n, nil
+}
+
+// oldest returns how many of the oldest events in `files` need to be
+// removed to free `bytes` bytes and `events` events. Compressed files
+// are evicted whole. Only the lines remove counts are counted, so
+// corrupt lines free their bytes along with the event after them.
+func (s *fileStore) oldest(files []string, bytes int64, events int) (int, error) {
+	n := 0
+
+	for _, path := range files {
+		if bytes <= 0 && events <= 0 {
+			break
+		}
+
+		if compressed(path) {
+			info, err := os.Stat(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+
+			count, err := s.count(path, info)
+			if err != nil {
+				return 0, err
+			}
+
+			n += count
+			bytes -= info.Size()
+			events -= count
+			continue
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		r := bufio.NewReader(f)
+		var corrupt int64
+
+		for bytes > 0 || events > 0 {
+			line, err := r.ReadBytes('\n')
+			if s.valid(line) {
+				n++
+				bytes -= corrupt + int64(len(line))
+				events--
+				corrupt = 0
+			} else {
+				corrupt += int64(len(line))
+			}
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return 0, err
+			}
+		}
+
+		f.Close()
+	}
+
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package analytics
+
+import "time"
+
+// expired returns true if the event is older than MaxEventAge.
+func (a *Analytics) expired(event *Event, now time.Time) bool {
+	if a.MaxEventAge <= 0 {
+		return false
+	}
+
+	t, err := parseTimestamp(event.Timestamp)
+	if err != nil {
+		return false
+	}
+
+	return now.Sub(t) > a.MaxEventAge
+}
+
+// unexpired returns the events that haven't expired.
+func (a *Analytics) unexpired(events []*Event) []*Event {
+	if a.MaxEventAge <= 0 {
+		return events
+	}
+
+	now := time.Now()
+	fresh := make([]*Event, 0, len(events))
+
+	for _, event := range events {
+		if !a.expired(event, now) {
+			fresh = append(fresh, event)
+		}
+	}
+
+	return fresh
+}
+
+// expire removes the expired events from the front of the queue,
+// reading more of the queue until it finds one that hasn't expired.
+func (a *Analytics) expire() error {
+	if a.MaxEventAge <= 0 || a.store == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	for n := 64; ; n *= 2 {
+		events, err := a.store.ReadBatch(n)
+		if err != nil {
+			return err
+		}
+
+		i := 0
+		for i < len(events) && a.expired(events[i], now) {
+			i++
+		}
+
+		if i < len(events) || len(events) < n {
+			if i == 0 {
+				return nil
+			}
+
+			a.Log.WithField("events", i).Debug("removing expired events")
+			if err := a.store.Remove(i); err != nil {
+				return err
+			}
+
+			if err := a.dequeued(i); err != nil {
+				return err
+			}
+
+			a.Metrics.Dropped(i)
+			return nil
+		}
+	}
+}
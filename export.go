@@ -0,0 +1,69 @@
+package analytics
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Format of exported events.
+type Format int
+
+// Export formats
+const (
+	FormatNDJSON Format = iota // One JSON event per line
+	FormatCSV                  // A header, then one event per row with its body as JSON
+)
+
+// Export writes the pending events to w, so users who opted out of
+// delivery can still share them, e.g. when reporting an issue. Events
+// are exported while tracking is disabled too.
+func (a *Analytics) Export(w io.Writer, format Format) error {
+	events, err := a.Events()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return errors.Wrap(err, "writing event")
+			}
+		}
+		return nil
+	case FormatCSV:
+		return exportCSV(w, events)
+	default:
+		return fmt.Errorf("unknown format %d", format)
+	}
+}
+
+// exportCSV writes the events as CSV.
+func exportCSV(w io.Writer, events []*Event) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "seq", "ts", "event", "body"})
+
+	for _, event := range events {
+		body, err := json.Marshal(event.Body)
+		if err != nil {
+			return errors.Wrap(err, "marshal error")
+		}
+
+		cw.Write([]string{
+			event.ID,
+			strconv.FormatUint(event.Seq, 10),
+			event.Timestamp,
+			event.Event,
+			string(body),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
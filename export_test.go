@@ -0,0 +1,27 @@
+package analytics
+
+import (
+	"io"
+	"os"
+)
+
+// ConfigPath is exported for testing the paths on other platforms.
+var ConfigPath = configPath
+
+// SetRandom replaces the source of nonces, returning a func to restore it.
+func SetRandom(r io.Reader) (restore func()) {
+	old := random
+	random = r
+	return func() { random = old }
+}
+
+// CountSyncs counts the events file's fsyncs in `n`, returning a func
+// to stop counting.
+func CountSyncs(n *int) (restore func()) {
+	old := fsync
+	fsync = func(f *os.File) error {
+		*n++
+		return old(f)
+	}
+	return func() { fsync = old }
+}
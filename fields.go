@@ -0,0 +1,33 @@
+package analytics
+
+// init the allowed and denied fields.
+func (a *Analytics) initFields() {
+	if len(a.AllowedFields) > 0 {
+		a.allowed = set(a.AllowedFields)
+	}
+
+	if len(a.DeniedFields) > 0 {
+		a.denied = set(a.DeniedFields)
+	}
+}
+
+// restrict removes the fields that aren't allowed or are denied. It runs
+// on the fields from Track, With and Set, before the library attaches
+// its own.
+func (a *Analytics) restrict(body Body) {
+	for k := range body {
+		if (a.allowed != nil && !a.allowed[k]) || a.denied[k] {
+			a.Log.WithField("field", k).Debug("removing restricted field")
+			delete(body, k)
+		}
+	}
+}
+
+// set of the keys.
+func set(keys []string) map[string]bool {
+	m := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		m[k] = true
+	}
+	return m
+}
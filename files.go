@@ -0,0 +1,145 @@
+package analytics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// file kept in memory when Config.Memory is set.
+type file struct {
+	data    []byte
+	modTime time.Time
+}
+
+// stateFiles are kept in the state directory, rather than with the config.
+var stateFiles = map[string]bool{
+	"last_flush": true,
+	"metrics":    true,
+	"seq":        true,
+	"corrupt":    true,
+	"checkpoint": true,
+	"attempts":   true,
+	"deadletter": true,
+	"breaker":    true,
+}
+
+// path returns the path to the file `name`.
+func (a *Analytics) path(name string) string {
+	if name == "id" && a.ShareID {
+		return filepath.Join(a.shared, name)
+	}
+
+	if stateFiles[name] || strings.HasPrefix(name, "events") {
+		return filepath.Join(a.stateRoot, name)
+	}
+
+	return filepath.Join(a.root, name)
+}
+
+// mkdir creates the config and state directories, restricting their
+// permissions if they already exist from an older version.
+func (a *Analytics) mkdir() error {
+	if a.Memory {
+		return nil
+	}
+
+	for _, dir := range []string{a.shared, a.root, a.stateRoot} {
+		if err := os.MkdirAll(dir, a.DirMode); err != nil {
+			return err
+		}
+
+		if err := os.Chmod(dir, a.DirMode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFile reads ~/<dir>/<name>.
+func (a *Analytics) readFile(name string) ([]byte, error) {
+	if a.Memory {
+		a.filesMu.Lock()
+		defer a.filesMu.Unlock()
+		f, ok := a.files[name]
+		if !ok {
+			return nil, notExist(name)
+		}
+		return f.data, nil
+	}
+
+	return ioutil.ReadFile(a.path(name))
+}
+
+// writeFile writes ~/<dir>/<name> atomically, so other processes
+// never see a partial file.
+func (a *Analytics) writeFile(name string, data []byte) error {
+	if a.Memory {
+		a.filesMu.Lock()
+		defer a.filesMu.Unlock()
+		a.files[name] = &file{data: data, modTime: time.Now()}
+		return nil
+	}
+
+	path := a.path(name)
+	tmp := path + ".tmp"
+
+	err := ioutil.WriteFile(tmp, data, a.FileMode)
+
+	// the directory is created on the first write
+	if os.IsNotExist(err) {
+		if err := a.mkdir(); err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(tmp, data, a.FileMode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// removeFile removes ~/<dir>/<name>.
+func (a *Analytics) removeFile(name string) error {
+	if a.Memory {
+		a.filesMu.Lock()
+		defer a.filesMu.Unlock()
+		if _, ok := a.files[name]; !ok {
+			return notExist(name)
+		}
+		delete(a.files, name)
+		return nil
+	}
+
+	return os.Remove(a.path(name))
+}
+
+// modTime returns when ~/<dir>/<name> was last written.
+func (a *Analytics) modTime(name string) (time.Time, error) {
+	if a.Memory {
+		a.filesMu.Lock()
+		defer a.filesMu.Unlock()
+		f, ok := a.files[name]
+		if !ok {
+			return time.Time{}, notExist(name)
+		}
+		return f.modTime, nil
+	}
+
+	info, err := os.Stat(a.path(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// notExist error compatible with os.IsNotExist.
+func notExist(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
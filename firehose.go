@@ -1,21 +1,20 @@
 package analytics
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
+	"context"
+	"crypto/cipher"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
 	uuid "github.com/hashicorp/go-uuid"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
@@ -23,210 +22,591 @@ import (
 
 // Event used for storage on disk.
 type Event struct {
-	Timestamp string                 `json:"ts"`    // Timestamp of the event
-	Event     string                 `json:"event"` // Event name
-	Body      map[string]interface{} `json:"body"`  // Body of the event
+	ID        string                 `json:"id,omitempty"`  // ID of the event, for de-duplication
+	Seq       uint64                 `json:"seq,omitempty"` // Seq is the per-install sequence number
+	Timestamp string                 `json:"ts"`            // Timestamp of the event
+	Event     string                 `json:"event"`         // Event name
+	Body      map[string]interface{} `json:"body"`          // Body of the event
+
+	offset int // offset in the queue plus one, set when flushing
 }
 
 // Config struct
 type Config struct {
-	Session *session.Session // Session credentials for AWS
-	Stream  string           // Stream we'll publish to on FH
-	Prefix  string           // Prefix the events with a string
-	Dir     string           // Dir we'll use. Defaults to stream name
-	Log     log.Interface    // Log (optional)
+	Session        *session.Session          // Session credentials for AWS
+	Client         firehoseiface.FirehoseAPI // Client for Firehose. Defaults to one created from Session
+	Endpoint       string                    // Endpoint override for Firehose, e.g. LocalStack (optional)
+	Region         string                    // Region override for Firehose (optional)
+	RoleARN        string                    // RoleARN to assume before delivering, e.g. in a central account (optional)
+	ExternalID     string                    // ExternalID passed when assuming RoleARN (optional)
+	Stream         string                    // Stream we'll publish to on FH
+	Backoff        Backoff                   // Backoff between retries of failed records
+	Parallelism    int                       // Parallelism sends up to this many batches of a backlog at once. Defaults to 1, above that the Sink and Middleware must be safe for concurrent use
+	Prefix         string                    // Prefix the events with a string
+	Dir            string                    // Dir we'll use. Defaults to stream name, streams sharing a Dir get their own subdirectory
+	ShareID        bool                      // ShareID shares the anonymous ID between streams using the same Dir
+	Path           string                    // Path to the directory we'll use, instead of Dir within the platform's config directory (optional)
+	Log            log.Interface             // Log (optional)
+	Sink           Sink                      // Sink events are delivered to. Defaults to Firehose
+	MaxEventSize   int                       // MaxEventSize in bytes. Defaults to Firehose's 1000KB record limit
+	Oversize       OversizePolicy            // Oversize policy for events over MaxEventSize. Defaults to dropping them
+	Middleware     []Middleware              // Middleware run on every Track and Flush (optional)
+	Filters        []Filter                  // Filters that can drop events before they're written (optional)
+	AllowedFields  []string                  // AllowedFields are the only body fields callers can track, others are removed (optional)
+	DeniedFields   []string                  // DeniedFields are body fields removed from every event (optional)
+	HashSalt       string                    // HashSalt hashes user_id and the Identifiers with SHA-256 before they're written (optional)
+	Identifiers    []string                  // Identifiers are body fields hashed when HashSalt is set (optional)
+	SampleRate     float64                   // SampleRate between 0 and 1 for all events. Defaults to 1
+	SampleRates    map[string]float64        // SampleRates by event name, overriding SampleRate (optional)
+	OnFlush        func(result FlushResult)  // OnFlush is called after each flush that sends events (optional)
+	OnError        func(err error)           // OnError is called when tracking or flushing fails (optional)
+	Metrics        Metrics                   // Metrics receives the library's own health, like dropped events (optional)
+	Tracer         Tracer                    // Tracer starts spans around flushes and their batches (optional)
+	Store          Store                     // Store for queued events. Defaults to ~/<dir>/events
+	SegmentSize    int64                     // SegmentSize in bytes at which ~/<dir>/events is rotated. Defaults to 8MB
+	MaxQueueSize   int64                     // MaxQueueSize in bytes of the events on disk (optional)
+	MaxQueueEvents int                       // MaxQueueEvents is the maximum number of events on disk (optional)
+	Eviction       EvictionPolicy            // Eviction policy once the queue is full. Defaults to evicting the oldest events
+	Compress       bool                      // Compress gzips the events once they're rotated into a segment
+	GzipRecords    bool                      // GzipRecords gzips each Firehose record, which start with gzip's magic number 0x1f 0x8b
+	Aggregate      bool                      // Aggregate packs events into newline-delimited Firehose records of up to 1000KB. Defaults to one event per record
+	Marshaler      Marshaler                 // Marshaler serializes each event into a Firehose record. Defaults to JSON
+	Partition      Partitioner               // Partition adds partition_keys to each JSON record for Firehose dynamic partitioning (optional)
+	RawRecords     bool                      // RawRecords sends each event without a trailing newline. Defaults to newline-delimited records for S3 and Athena
+	EncryptionKey  []byte                    // EncryptionKey encrypts events, traits and the group on disk with AES-GCM (optional)
+	KeepCorrupt    bool                      // KeepCorrupt moves unreadable events to ~/<dir>/corrupt instead of dropping them
+	MaxEventAge    time.Duration             // MaxEventAge drops queued events older than this instead of sending them (optional)
+	MaxAttempts    int                       // MaxAttempts moves events to ~/<dir>/deadletter after failing to send this many flushes in a row (optional)
+	Breaker        int                       // Breaker skips flushes after this many fail in a row, until the Cooldown elapses (optional)
+	Cooldown       time.Duration             // Cooldown before flushing again once the Breaker opens. Defaults to 5m
+	Archive        int                       // Archive keeps the last N flushed batches in ~/<dir>/archive (optional)
+	SyncEvery      int                       // SyncEvery fsyncs the events after this many are tracked, 1 being every event. Defaults to leaving it to the OS
+	WriteBuffer    int                       // WriteBuffer in bytes holds tracked events in memory until it's full, a flush, Sync or Close. Defaults to writing every event
+	FileMode       os.FileMode               // FileMode of the files in ~/<dir>. Defaults to 0600
+	DirMode        os.FileMode               // DirMode of ~/<dir>. Defaults to 0700
+	FlushOnClose   bool                      // FlushOnClose does a best-effort flush before closing
+	FlushTimeout   time.Duration             // FlushTimeout bounds the flush on close. Defaults to 5s
+	EnvVar         string                    // EnvVar that opts in or out, e.g. MYAPP_ANALYTICS=0 (optional)
+	CI             CIPolicy                  // CI policy for CI environments. Defaults to tagging events
+	SchemaVersion  int                       // SchemaVersion stamped on every event as schema_version (optional)
+	Upgrades       []Upgrade                 // Upgrades migrate queued events from older schema versions when they're flushed (optional)
+	Version        string                    // Version of the app, stamped on every event as app_version (optional)
+	Enrich         bool                      // Enrich tags every event with os, arch, go_version, terminal and ci
+	MachineSalt    string                    // MachineSalt tags every event with machine_id, the salted hash of the hostname and MAC address (optional)
+	Timestamps     TimestampFormat           // Timestamps format. Defaults to RFC3339 at second precision
+	Locale         bool                      // Locale tags every event with the locale, tz_offset in minutes and time_of_day
+	Memory         bool                      // Memory keeps events and state in memory, never touching disk
+	DryRun         bool                      // DryRun flushes without sending or removing the events, logging them instead
+
+	// CreateStream creates the stream with the S3Destination
+	// template on the first flush if it doesn't exist yet
+	CreateStream  bool
+	S3Destination *firehose.ExtendedS3DestinationConfiguration
 }
 
 func (c *Config) defaults() {
 	if c.Log == nil {
 		c.Log = log.Log
 	}
+
+	if c.FlushTimeout <= 0 {
+		c.FlushTimeout = 5 * time.Second
+	}
+
+	if c.Cooldown <= 0 {
+		c.Cooldown = 5 * time.Minute
+	}
+
+	if c.MaxEventSize <= 0 {
+		c.MaxEventSize = maxEventSize
+		if !c.RawRecords {
+			c.MaxEventSize-- // room for the newline
+		}
+	}
+
+	if c.FileMode == 0 {
+		c.FileMode = 0600
+	}
+
+	if c.DirMode == 0 {
+		c.DirMode = 0700
+	}
+
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = segmentSize
+	}
+
+	if c.Metrics == nil {
+		c.Metrics = nopMetrics{}
+	}
+
+	if c.Tracer == nil {
+		c.Tracer = nopTracer{}
+	}
+
+	if c.Sink == nil && (c.Session != nil || c.Client != nil) {
+		c.Sink = &FirehoseSink{
+			Session:       c.Session,
+			Client:        c.Client,
+			Endpoint:      c.Endpoint,
+			Region:        c.Region,
+			RoleARN:       c.RoleARN,
+			ExternalID:    c.ExternalID,
+			Stream:        c.Stream,
+			Backoff:       c.Backoff,
+			Gzip:          c.GzipRecords,
+			Aggregate:     c.Aggregate,
+			Raw:           c.RawRecords,
+			Marshaler:     c.Marshaler,
+			Partition:     c.Partition,
+			Metrics:       c.Metrics,
+			Tracer:        c.Tracer,
+			CreateStream:  c.CreateStream,
+			S3Destination: c.S3Destination,
+		}
+	}
 }
 
-// New Analytics instance
-func New(config *Config) *Analytics {
+// validate the config, once the defaults are filled in.
+func (c *Config) validate() error {
+	if c.Stream == "" {
+		return errors.New("missing stream name")
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.Errorf("sample rate %v isn't between 0 and 1", c.SampleRate)
+	}
+
+	for name, rate := range c.SampleRates {
+		if rate < 0 || rate > 1 {
+			return errors.Errorf("sample rate %v of %q isn't between 0 and 1", rate, name)
+		}
+	}
+
+	switch {
+	case c.Parallelism < 0:
+		return errors.New("parallelism can't be negative")
+	case c.MaxQueueSize < 0 || c.MaxQueueEvents < 0:
+		return errors.New("max queue size can't be negative")
+	case c.MaxAttempts < 0:
+		return errors.New("max attempts can't be negative")
+	case c.Breaker < 0:
+		return errors.New("breaker can't be negative")
+	case c.Archive < 0 || c.SyncEvery < 0 || c.WriteBuffer < 0:
+		return errors.New("archive, sync and buffer sizes can't be negative")
+	}
+
+	if _, ok := c.Marshaler.(*GlueSchema); ok && c.Partition != nil {
+		return errors.New("partition keys can't be added to Glue schema records")
+	}
+
+	switch len(c.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		return errors.Errorf("encryption key must be 16, 24 or 32 bytes, not %d", len(c.EncryptionKey))
+	}
+
+	return nil
+}
+
+// New Analytics instance publishing to `stream`.
+func New(stream string, opts ...Option) *Analytics {
+	config := &Config{
+		Stream: stream,
+	}
+
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	return NewFromConfig(config)
+}
+
+// NewFromConfig creates an Analytics instance from a config.
+func NewFromConfig(config *Config) *Analytics {
 	config.defaults()
 
 	a := &Analytics{
-		Config:  config,
-		globals: Body{},
+		Config: config,
+		state: &state{
+			globals: Body{},
+			files:   map[string]*file{},
+		},
 	}
 
 	a.init()
 	return a
 }
 
-// Analytics struct
+// Analytics struct. Tracking, Set, Identify and Group are safe to
+// call from several goroutines at once.
 type Analytics struct {
 	*Config
-	root       string
-	userID     string
-	eventsFile *os.File
-	events     *json.Encoder
-	globals    Body
+	*state
+	fields Body // scoped fields from With
+}
+
+// state shared between an Analytics instance and its children
+type state struct {
+	mu sync.Mutex // mu guards the state written by concurrent tracking
+
+	root      string // root for config, e.g. the id
+	stateRoot string // stateRoot for state, e.g. the events
+	shared    string // shared root for streams using the same Dir
+	userID    string
+	store     Store
+	lifecycle Lifecycle
+	initErr   error // initErr is why the client is uninitialized
+	identity  *identity
+	group     *group
+	metrics   metrics
+	seq       uint64
+	seqEnd    uint64 // seqEnd of the reserved block of sequence numbers
+	seqLock   *flock // seqLock guards ~/<dir>/seq between processes
+	consent   Consent
+	ci        bool
+	flushErr  error // flushErr of the last flush
+	failures  int   // failures of flushes in a row
+	globals   Body
+	env       Body             // env fields, if Enrich is set
+	session   string           // session of this run
+	machine   string           // machine ID, if there's a salt
+	allowed   map[string]bool  // allowed fields, if restricted
+	denied    map[string]bool  // denied fields
+	created   bool             // created ~/<dir> on the first write
+	files     map[string]*file // files kept in memory
+	filesMu   sync.Mutex       // filesMu guards files
+	flightMu  sync.Mutex       // flightMu guards inflight
+	inflight  *flight          // inflight flush, if there is one
+	aead      cipher.AEAD      // aead encrypts files, if there's a key
+}
+
+// With returns a child that shares the same queue, adding `body` to
+// every event it tracks. Closing the child closes the shared queue.
+func (a *Analytics) With(body Body) *Analytics {
+	fields := Body{}
+	for k, v := range a.fields {
+		fields.Set(k, v)
+	}
+	for k, v := range body {
+		fields.Set(k, v)
+	}
+
+	return &Analytics{
+		Config: a.Config,
+		state:  a.state,
+		fields: fields,
+	}
 }
 
 // Initialize:
 //
 // - ~/<dir>
 // - ~/<dir>/id
-// - ~/<dir>/events
-// - ~/<dir>/last_flush
-//
+// - ~/<dir>/traits
+// - ~/<dir>/group
+// - ~/<state>/<dir>/events
+// - ~/<state>/<dir>/last_flush
+// - ~/<state>/<dir>/seq
 func (a *Analytics) init() {
+	if err := a.Config.validate(); err != nil {
+		a.fail(err, "invalid config")
+		return
+	}
+
 	if err := a.initRoot(); err != nil {
-		a.Log.WithError(err).Error("couldn't create root")
+		a.fail(err, "couldn't create root")
 		return
 	}
 
-	enabled, err := a.Enabled()
-	if err != nil || !enabled {
+	a.ci = a.CI != CIIgnore && isCI()
+	a.initSession()
+	a.initFields()
+
+	if a.MachineSalt != "" {
+		a.machine = machineID(a.MachineSalt)
+	}
+
+	if a.Enrich {
+		a.env = environment(a.ci)
+	}
+
+	if !a.Memory {
+		a.migrateState()
+	}
+
+	if a.EncryptionKey != nil {
+		aead, err := newAEAD(a.EncryptionKey)
+		if err != nil {
+			a.fail(err, "couldn't create cipher")
+			return
+		}
+		a.aead = aead
+	}
+
+	switch {
+	case a.Store != nil:
+		a.store = a.Store
+	case a.Memory:
+		a.store = &MemoryStore{}
+	default:
+		s := newFileStore(filepath.Join(a.stateRoot, "events"), a.FileMode)
+		s.size = a.SegmentSize
+		s.maxBytes = a.MaxQueueSize
+		s.maxEvents = a.MaxQueueEvents
+		s.evict = a.Eviction
+		s.compress = a.Compress
+		s.aead = a.aead
+		s.syncEvery = a.SyncEvery
+		s.metrics = a.Metrics
+		s.bufSize = a.WriteBuffer
+		if a.KeepCorrupt {
+			s.corrupt = filepath.Join(a.stateRoot, "corrupt")
+		}
+		s.log = a.Log
+		a.store = s
+	}
+
+	consent, err := a.Consent()
+	if err != nil {
+		a.fail(err, "couldn't read consent")
+		return
+	} else if consent == ConsentOff {
 		a.Log.Debug("disabled")
+		a.lifecycle = LifecycleDisabled
 		return
 	}
 
-	a.initDir()
+	a.consent = consent
+	a.open()
+
+	if err := a.expire(); err != nil {
+		a.Log.WithError(err).Debug("error removing expired events")
+	}
+}
+
+// open the directory, enabling tracking.
+func (a *Analytics) open() {
+	if a.store == nil {
+		return
+	}
+
+	a.mu.Lock()
+	a.lifecycle = LifecycleOpen
+	a.mu.Unlock()
+
 	a.initID()
-	a.initEvents()
+	a.initTraits()
+	a.initGroup()
+	a.initSeq()
+}
+
+// active returns true if we're enabled and can write events.
+func (a *Analytics) active() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lifecycle == LifecycleOpen
 }
 
 // init root directory.
 func (a *Analytics) initRoot() error {
+	if a.Path != "" {
+		root, err := filepath.Abs(a.Path)
+		if err != nil {
+			return err
+		}
+		a.root = root
+		a.stateRoot = root
+		a.shared = root
+		return nil
+	}
+
 	dir := a.Dir
 	if dir == "" {
 		dir = a.Stream
 	}
 
-	root, err := getPath(dir)
+	shared, err := getPath(dir)
 	if err != nil {
 		return err
 	}
-	a.root = root
+	a.root = shared
+	a.shared = shared
 
-	return nil
-}
+	stateRoot, err := getStatePath(dir)
+	if err != nil {
+		return err
+	}
+	a.stateRoot = stateRoot
+
+	// streams sharing a Dir are isolated in subdirectories
+	if dir != a.Stream {
+		a.root = filepath.Join(shared, a.Stream)
+		a.stateRoot = filepath.Join(stateRoot, a.Stream)
+		if !a.Memory {
+			a.migrateDir(shared, stateRoot)
+		}
+	}
 
-// init ~/<dir>.
-func (a *Analytics) initDir() {
-	os.Mkdir(a.root, 0755)
+	return nil
 }
 
 // init ~/<dir>/id.
 func (a *Analytics) initID() {
-	path := filepath.Join(a.root, "id")
-
-	b, err := ioutil.ReadFile(path)
+	b, err := a.readFile("id")
 	if err == nil {
 		a.userID = string(b)
 		a.Log.Debug("id already created")
 		return
 	}
 
-	a.Log.Debug("creating id")
+	// saved by create on the first write
 	id, err := uuid.GenerateUUID()
 	if err != nil {
 		return
 	}
 	a.userID = string(id)
+}
 
-	err = ioutil.WriteFile(path, []byte(id), 0666)
-	if err != nil {
-		a.Log.WithError(err).Debug("error saving id")
-		return
+// create ~/<dir> and save a new id on the first write, so constructing
+// the client doesn't touch the filesystem.
+func (a *Analytics) create() error {
+	if a.created {
+		return nil
 	}
 
-	a.Touch()
-}
-
-// init ~/<dir>/events.
-func (a *Analytics) initEvents() {
-	path := filepath.Join(a.root, "events")
+	if err := a.mkdir(); err != nil {
+		return errors.Wrap(err, "creating dir")
+	}
 
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		log.WithError(err).Debug("error opening events")
-		return
+	if _, err := a.readFile("id"); os.IsNotExist(err) {
+		a.Log.Debug("creating id")
+		if err := a.writeFile("id", []byte(a.userID)); err != nil {
+			a.Log.WithError(err).Debug("error saving id")
+		} else {
+			a.Touch()
+		}
 	}
-	a.eventsFile = f
 
-	a.events = json.NewEncoder(f)
+	a.created = true
+	return nil
 }
 
-// Enabled returns true if the user hasn't opted out.
+// Enabled returns true if the user hasn't opted out, consenting
+// to errors or everything.
 func (a *Analytics) Enabled() (bool, error) {
-	_, err := os.Stat(filepath.Join(a.root, "disable"))
-
-	if os.IsNotExist(err) {
-		return true, nil
+	consent, err := a.Consent()
+	if err != nil {
+		return false, err
 	}
 
-	return false, err
+	return consent != ConsentOff, nil
 }
 
-// Disable tracking. This method creates ~/<dir>/disable.
+// Disable tracking. This method saves off to ~/<dir>/consent.
 func (a *Analytics) Disable() error {
 	a.Log.Debug("disable")
-	_, err := os.Create(filepath.Join(a.root, "disable"))
-	return err
+	return a.SetEnabled(false)
 }
 
-// Enable tracking. This method removes ~/<dir>/disable.
+// Enable tracking everything. This method removes ~/<dir>/consent.
 func (a *Analytics) Enable() error {
 	a.Log.Debug("enable")
-	return os.Remove(filepath.Join(a.root, "disable"))
+	return a.SetEnabled(true)
 }
 
-// Events reads the events from disk.
-func (a *Analytics) Events() (v []*Event, err error) {
-	f, err := os.Open(filepath.Join(a.root, "events"))
-	if err != nil {
-		return nil, errors.Wrap(err, "opening")
+// envEnabled checks the CI policy, DO_NOT_TRACK and the EnvVar,
+// returning false for ok if none of them say anything.
+func (a *Analytics) envEnabled() (enabled bool, ok bool) {
+	if a.ci && a.CI == CISuppress {
+		return false, true
 	}
 
-	dec := json.NewDecoder(f)
+	if v := os.Getenv("DO_NOT_TRACK"); v != "" {
+		dnt, err := strconv.ParseBool(v)
+		if err != nil || dnt {
+			return false, true
+		}
+	}
 
-	for {
-		var e Event
-		err := dec.Decode(&e)
+	if a.EnvVar == "" {
+		return false, false
+	}
 
-		if err == io.EOF {
-			break
-		}
+	v := os.Getenv(a.EnvVar)
+	if v == "" {
+		return false, false
+	}
 
-		if err != nil {
-			return nil, errors.Wrap(err, "decoding")
-		}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		a.Log.WithField("value", v).Debugf("invalid %s", a.EnvVar)
+		return false, false
+	}
 
-		v = append(v, &e)
+	return enabled, true
+}
+
+// SetEnabled enables or disables tracking for this instance and
+// persists the choice, consenting to everything or nothing.
+func (a *Analytics) SetEnabled(enabled bool) error {
+	if enabled {
+		return a.SetConsent(ConsentFull)
 	}
 
-	return v, nil
+	return a.SetConsent(ConsentOff)
+}
+
+// Events reads the queued events.
+func (a *Analytics) Events() ([]*Event, error) {
+	if a.store == nil {
+		return nil, errors.New("no store")
+	}
+
+	return a.store.ReadBatch(0)
 }
 
 // Size returns the number of events.
 func (a *Analytics) Size() (int, error) {
-	events, err := a.Events()
+	if a.store == nil {
+		return 0, errors.New("no store")
+	}
+
+	n, err := a.store.Size()
 	if err != nil {
 		return 0, errors.Wrap(err, "reading events")
 	}
 
-	return len(events), nil
+	return n, nil
+}
+
+// Sync writes any buffered events and flushes them to disk.
+func (a *Analytics) Sync() error {
+	s, ok := a.store.(syncer)
+	if !ok {
+		return nil
+	}
+
+	if err := s.Sync(); err != nil {
+		return errors.Wrap(err, "syncing events")
+	}
+
+	return nil
 }
 
 // Touch ~/<dir>/last_flush.
 func (a *Analytics) Touch() error {
-	path := filepath.Join(a.root, "last_flush")
-	return ioutil.WriteFile(path, []byte(":)"), 0755)
+	return a.writeFile("last_flush", []byte(":)"))
 }
 
 // LastFlush returns the last flush time.
 func (a *Analytics) LastFlush() (time.Time, error) {
-	info, err := os.Stat(filepath.Join(a.root, "last_flush"))
+	t, err := a.modTime("last_flush")
 	if err != nil {
 		return time.Unix(0, 0), err
 	}
 
-	return info.ModTime(), nil
+	return t, nil
 }
 
 // LastFlushDuration returns the last flush time delta.
@@ -256,23 +636,94 @@ func (a *Analytics) Body(key string, value interface{}) Body {
 }
 
 // Set global fields included in every event
-// This is not concurrency safe
 func (a *Analytics) Set(body Body) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	for k, v := range body {
 		a.globals.Set(k, v)
 	}
 }
 
-// Track event `name` with optional `data`.
+// Track event `name` with optional `data`, if the user consented
+// to tracking everything.
 func (a *Analytics) Track(name string, body Body) error {
-	if a.events == nil {
+	return a.TrackTier(ConsentFull, name, body)
+}
+
+// TrackAt tracks event `name` that happened at `t` rather than now,
+// for importers and deferred instrumentation.
+func (a *Analytics) TrackAt(t time.Time, name string, body Body) error {
+	if ok, err := a.admits(ConsentFull); err != nil {
+		return a.report(err)
+	} else if !ok {
 		return nil
 	}
 
+	return a.report(a.track(a.eventAt(t, name, body), a.write))
+}
+
+// Eventer is implemented by strongly typed events.
+type Eventer interface {
+	EventName() string
+	EventBody() Body
+}
+
+// TrackEvent tracks a typed event.
+func (a *Analytics) TrackEvent(e Eventer) error {
+	return a.Track(e.EventName(), e.EventBody())
+}
+
+// TrackNow sends event `name` with optional `data` straight to the sink,
+// bypassing the disk queue. This is useful for high-value events like
+// crashes. The event is queued on disk if sending fails.
+func (a *Analytics) TrackNow(name string, body Body) error {
+	if ok, err := a.admits(ConsentFull); err != nil {
+		return a.report(err)
+	} else if !ok {
+		return nil
+	}
+
+	return a.report(a.track(a.event(name, body), func(event *Event) error {
+		if a.Sink == nil {
+			return a.write(event)
+		}
+
+		a.mu.Lock()
+		a.stamp(event)
+		a.mu.Unlock()
+
+		if err := sendEvent(context.Background(), a.Sink, event); err != nil {
+			a.Log.WithError(err).Debug("error sending event, queueing it")
+			return a.write(event)
+		}
+
+		return nil
+	}))
+}
+
+// event creates an event that happened now.
+func (a *Analytics) event(name string, body Body) *Event {
+	return a.eventAt(time.Now(), name, body)
+}
+
+// eventAt creates an event that happened at `t`, attaching any scoped
+// fields and globals.
+func (a *Analytics) eventAt(t time.Time, name string, body Body) *Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	if body == nil {
 		body = Body{}
 	}
 
+	// attach any scoped fields
+	for k, v := range a.fields {
+		if body[k] == nil {
+			body.Set(k, v)
+		}
+	}
+
 	// attach any globals
 	for k, v := range a.globals {
 		if body[k] == nil {
@@ -280,15 +731,75 @@ func (a *Analytics) Track(name string, body Body) error {
 		}
 	}
 
-	return a.events.Encode(&Event{
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	a.restrict(body)
+
+	// attach the environment
+	for k, v := range a.env {
+		if body[k] == nil {
+			body.Set(k, v)
+		}
+	}
+
+	if a.ci && body["ci"] == nil {
+		body.Set("ci", true)
+	}
+
+	a.attachIdentity(body)
+	a.attachGroup(body)
+	a.attachSession(body)
+	a.attachMachine(body)
+	a.attachVersion(body)
+	a.attachSchema(body)
+	a.attachLocale(body, t)
+	a.hashIdentifiers(body)
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		a.Log.WithError(err).Debug("error generating event id")
+	}
+
+	return &Event{
+		ID:        id,
+		Timestamp: a.Timestamps.format(t),
 		Event:     a.Config.Prefix + name,
 		Body:      body,
-	})
+	}
+}
+
+// write the event to the store.
+func (a *Analytics) write(event *Event) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// the store may be closing
+	if a.lifecycle == LifecycleClosed {
+		return ErrClosed
+	}
+
+	if err := a.create(); err != nil {
+		return err
+	}
+
+	a.stamp(event)
+
+	events, err := a.fit(event)
+	if err != nil {
+		return err
+	} else if len(events) == 0 {
+		a.Metrics.Dropped(1)
+		return nil
+	}
+
+	if err := a.store.Append(events...); err != nil {
+		return err
+	}
+
+	a.Metrics.Tracked(len(events))
+	return nil
 }
 
 // MaybeFlush flushes if event count is above `aboveSize`, or age is `aboveDuration`,
-// otherwise Close() is called and the underlying file(s) are closed.
+// then Close() is called and the underlying file(s) are closed.
 func (a *Analytics) MaybeFlush(aboveSize int, aboveDuration time.Duration) error {
 	age, err := a.LastFlushDuration()
 	if err != nil {
@@ -310,91 +821,341 @@ func (a *Analytics) MaybeFlush(aboveSize int, aboveDuration time.Duration) error
 	switch {
 	case size >= aboveSize:
 		ctx.Debug("flush size")
-		return a.Flush()
 	case age >= aboveDuration:
 		ctx.Debug("flush age")
-		return a.Flush()
 	default:
 		return a.Close()
 	}
+
+	if a.breakerOpen() {
+		ctx.Debug("breaker open")
+		return a.Close()
+	}
+
+	if err := a.Flush(); err != nil {
+		a.Close()
+		return err
+	}
+
+	return a.Close()
 }
 
-// Flush the events to Segment, removing them from disk.
+// Flush the events to the sink, removing them from the queue.
 func (a *Analytics) Flush() error {
-	// Ignore if we don't have a session
-	if a.Session == nil {
-		return nil
-	} else if a.Stream == "" {
-		return fmt.Errorf("missing stream name")
+	return a.FlushContext(context.Background())
+}
+
+// FlushAsync flushes the events in the background, returning
+// a channel that receives the result once it's done.
+func (a *Analytics) FlushAsync() <-chan error {
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- a.Flush()
+		close(errc)
+	}()
+
+	return errc
+}
+
+// FlushContext flushes the events to the sink, giving up
+// when the context is cancelled or its deadline passes. Calls made
+// while a flush is in flight wait for it and share its result.
+func (a *Analytics) FlushContext(ctx context.Context) error {
+	return a.singleFlight(ctx, func() error {
+		return a.flushContext(ctx)
+	})
+}
+
+// flushContext flushes, recording the result.
+func (a *Analytics) flushContext(ctx context.Context) error {
+	if a.breakerOpen() {
+		a.Log.Debug("breaker open, skipping flush")
+		return ErrBreakerOpen
 	}
 
-	if err := a.Close(); err != nil {
-		return errors.Wrap(err, "close error")
+	ctx, span := a.Tracer.Start(ctx, "analytics.flush")
+	span.Set("stream", a.Stream)
+
+	start := time.Now()
+	n, err := a.flush(ctx)
+	span.Set("events", n)
+	span.End(err)
+	a.record(err)
+
+	if err := a.trip(ctx, err); err != nil {
+		a.Log.WithError(err).Debug("error saving breaker")
 	}
 
-	events, err := a.Events()
-	if err != nil {
-		return errors.Wrap(err, "reading events")
-	} else if len(events) == 0 {
-		return nil
+	a.Metrics.FlushDuration(time.Since(start))
+	if m, ok := a.Metrics.(flushResulter); ok {
+		m.FlushResult(err)
 	}
 
-	var records []*firehose.Record
-	for _, event := range events {
-		record, err := json.Marshal(event)
-		if err != nil {
-			return errors.Wrapf(err, "marshal error")
+	if n > 0 && a.OnFlush != nil {
+		a.OnFlush(FlushResult{
+			Events:   n,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}
+
+	return a.report(err)
+}
+
+// deliver sends the events that haven't expired or been sent already,
+// returning the ones it tried to send.
+func (a *Analytics) deliver(ctx context.Context, events []*Event) ([]*Event, error) {
+	fresh := a.unexpired(events)
+	if expired := len(events) - len(fresh); expired > 0 {
+		a.Metrics.Dropped(expired)
+	}
+
+	send, err := a.unsent(fresh)
+	if err != nil || len(send) == 0 {
+		return nil, err
+	}
+
+	send = a.upgrade(send)
+	if send, err = a.validate(ctx, send); err != nil || len(send) == 0 {
+		return nil, err
+	}
+
+	ctx, span := a.Tracer.Start(ctx, "analytics.batch")
+	span.Set("events", len(send))
+	err = a.send(ctx, send)
+	span.End(err)
+
+	return send, err
+}
+
+// flush returns the number of events it tried to send.
+func (a *Analytics) flush(ctx context.Context) (int, error) {
+	// Ignore if we don't have a sink
+	if a.Sink == nil && !a.DryRun {
+		return 0, nil
+	}
+
+	if a.active() {
+		if err := a.rollup(); err != nil {
+			return 0, errors.Wrap(err, "rolling up metrics")
 		}
-		records = append(records, &firehose.Record{Data: record})
 	}
 
-	// setup the firehose client
-	fh := firehose.New(a.Session)
-	retries := 3
+	// hold the lock so other processes can't send the same events
+	if l, ok := a.store.(locker); ok {
+		if err := l.Lock(); err != nil {
+			return 0, errors.Wrap(err, "locking")
+		}
+		defer l.Unlock()
+	}
 
-retry:
-	output, err := fh.PutRecordBatch(&firehose.PutRecordBatchInput{
-		DeliveryStreamName: aws.String(a.Stream),
-		Records:            records,
-	})
-	if err != nil {
-		return errors.Wrap(err, "error sending records to firehose")
-	} else if output.FailedPutCount != nil && *output.FailedPutCount > 0 {
-		newRecords := []*firehose.Record{}
-		for i, res := range output.RequestResponses {
-			if res.ErrorCode != nil {
-				newRecords = append(newRecords, records[i])
+	// stream segmented stores a segment at a time, except in dry
+	// runs which read every segment as they don't remove them
+	s, streaming := a.store.(streamer)
+	streaming = streaming && !a.DryRun
+	n := 0
+
+	for {
+		var read int
+		var sent []string
+		var failed []*Event
+		var mu sync.Mutex
+		p := newPool(a.Parallelism)
+
+		// batches are sent by the pool, keeping track of the events
+		// sent so they can be checkpointed if another batch fails
+		offset := 0
+		deliver := func(events []*Event) error {
+			for _, event := range events {
+				offset++
+				event.offset = offset
 			}
+
+			return p.do(func() error {
+				send, err := a.deliver(ctx, events)
+
+				mu.Lock()
+				defer mu.Unlock()
+				n += len(send)
+
+				if err != nil {
+					ok := accepted(send, err)
+					sent = append(sent, ok...)
+					failed = append(failed, rejected(send, ok)...)
+					a.Metrics.Flushed(len(ok))
+					a.Metrics.Failed(len(send) - len(ok))
+					return errors.Wrap(err, "sending events")
+				}
+
+				for _, event := range send {
+					sent = append(sent, event.key())
+				}
+				a.Metrics.Flushed(len(send))
+
+				if len(send) > 0 && !a.DryRun {
+					if err := a.archive(send); err != nil {
+						a.Log.WithError(err).Debug("error archiving events")
+					}
+				}
+
+				return nil
+			})
 		}
-		records = newRecords
-		retries--
-		if retries > 0 {
-			goto retry
+
+		var err error
+		if streaming {
+			read, err = s.Stream(deliver)
 		} else {
-			return errors.Wrapf(err, "couldn't send all the records")
+			var events []*Event
+			if events, err = a.Events(); err != nil {
+				err = errors.Wrap(err, "reading events")
+			} else if read = len(events); read > 0 {
+				err = deliver(events)
+			}
+		}
+
+		if werr := p.wait(); err == nil {
+			err = werr
+		}
+
+		if err != nil {
+			// give up on events that keep failing, unless we ran out of time
+			if ctx.Err() == nil {
+				dead, derr := a.attempt(failed)
+				if derr != nil {
+					a.Log.WithError(derr).Debug("error counting attempts")
+				}
+				sent = append(sent, dead...)
+			}
+
+			if err := a.checkpoint(sent); err != nil {
+				a.Log.WithError(err).Debug("error saving checkpoint")
+			}
+			return n, err
+		}
+
+		// dry runs leave the events queued
+		if read == 0 || a.DryRun {
+			break
+		}
+
+		if err := a.store.Remove(read); err != nil {
+			return n, errors.Wrap(err, "removing events")
+		}
+
+		if err := a.clearCheckpoint(); err != nil {
+			return n, errors.Wrap(err, "clearing checkpoint")
+		}
+
+		// the rest of the events have moved up the queue
+		if err := a.clearAttempts(); err != nil {
+			return n, errors.Wrap(err, "clearing attempts")
+		}
+
+		if !streaming {
+			break
 		}
 	}
 
+	if n == 0 || a.DryRun {
+		return n, nil
+	}
+
 	if err := a.Touch(); err != nil {
-		return errors.Wrap(err, "touching")
+		return n, errors.Wrap(err, "touching")
 	}
 
-	return os.Remove(filepath.Join(a.root, "events"))
+	return n, nil
+}
+
+// FlushResult describes a flush that sent events.
+type FlushResult struct {
+	Events   int           // Events we tried to send
+	Duration time.Duration // Duration of the flush
+	Err      error         // Err if the flush failed
+}
+
+// report the error to OnError, if any.
+func (a *Analytics) report(err error) error {
+	if err != nil && a.OnError != nil {
+		a.OnError(err)
+	}
+	return err
 }
 
 // Close the underlying file descriptor(s).
 func (a *Analytics) Close() error {
-	return a.eventsFile.Close()
+	return a.CloseContext(context.Background())
+}
+
+// CloseContext closes the underlying file descriptor(s). The context
+// bounds any work that needs to happen before closing.
+func (a *Analytics) CloseContext(ctx context.Context) error {
+	if a.FlushOnClose && a.active() {
+		ctx, cancel := context.WithTimeout(ctx, a.FlushTimeout)
+		defer cancel()
+
+		// best-effort, events stay on disk if this fails
+		if err := a.FlushContext(ctx); err != nil {
+			a.Log.WithError(err).Debug("error flushing on close")
+		}
+	}
+
+	return a.close()
+}
+
+// close saves the metrics and closes the store.
+func (a *Analytics) close() error {
+	// writes check the lifecycle under the lock, so
+	// none are in progress once it's closed
+	a.mu.Lock()
+	if a.lifecycle == LifecycleClosed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.lifecycle = LifecycleClosed
+	a.mu.Unlock()
+
+	if a.store == nil {
+		return nil
+	}
+
+	if err := a.saveMetrics(); err != nil {
+		a.Log.WithError(err).Debug("error saving metrics")
+	}
+
+	a.mu.Lock()
+	if err := a.releaseSeq(); err != nil {
+		a.Log.WithError(err).Debug("error releasing seq")
+	}
+	if a.seqLock != nil {
+		a.seqLock.close()
+	}
+	a.mu.Unlock()
+
+	return a.store.Close()
 }
 
 // get the path to the storage
 func getPath(paths ...string) (p string, err error) {
+	return configPath(runtime.GOOS, paths...)
+}
+
+// configPath returns the path to the storage on `goos`.
+func configPath(goos string, paths ...string) (p string, err error) {
+	switch goos {
+	case "darwin", "linux", "windows":
+	default:
+		return path.Join(append([]string{userConfigDir()}, paths...)...), nil
+	}
+
 	home, err := homedir.Dir()
 	if err != nil {
 		return p, err
 	}
 
-	switch runtime.GOOS {
+	switch goos {
 	case "darwin":
 		ps := append([]string{home, "Library", "Preferences"}, paths...)
 		return path.Join(ps...), err
@@ -405,7 +1166,7 @@ func getPath(paths ...string) (p string, err error) {
 		}
 		ps := append([]string{base}, paths...)
 		return path.Join(ps...), err
-	case "windows":
+	default: // windows
 		appdata := os.Getenv("LOCALAPPDATA")
 		if appdata == "" {
 			appdata = path.Join(home, "AppData", "Local")
@@ -413,7 +1174,5 @@ func getPath(paths ...string) (p string, err error) {
 		ps := append([]string{appdata}, paths...)
 		ps = append(ps, "Config")
 		return path.Join(ps...), err
-	default:
-		return p, errors.New("store does not yet support " + runtime.GOOS + ". Please open a pull request!")
 	}
 }
@@ -1,17 +1,53 @@
 package analytics_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/matthewmueller/firehose-analytics"
 )
 
+// home sets up empty config and state directories in a temporary
+// directory, returning it.
+func home(t *testing.T) string {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir+"/config")
+	t.Setenv("XDG_STATE_HOME", dir+"/state")
+	return dir
+}
+
 func sesh(t *testing.T) *session.Session {
 	sess, err := session.NewSession(&aws.Config{
 		Credentials: credentials.NewStaticCredentials(
@@ -28,12 +64,11 @@ func sesh(t *testing.T) *session.Session {
 }
 
 func TestAnalytics(t *testing.T) {
-	a := analytics.New(&analytics.Config{
-		Prefix:  "app:",
-		Session: sesh(t),
-		Stream:  os.Getenv("FIREHOSE_STREAM_NAME"),
-		Log:     log.Log,
-	})
+	a := analytics.New(os.Getenv("FIREHOSE_STREAM_NAME"),
+		analytics.WithPrefix("app:"),
+		analytics.WithSession(sesh(t)),
+		analytics.WithLogger(log.Log),
+	)
 
 	if err := a.Track("cool", a.Body("very", "nice")); err != nil {
 		t.Fatal(err)
@@ -45,3 +80,3870 @@ func TestAnalytics(t *testing.T) {
 	}
 	log.Infof("time: %s", time.Since(start))
 }
+
+type sink struct {
+	events []*analytics.Event
+	err    error
+}
+
+func (s *sink) Send(ctx context.Context, events []*analytics.Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.New("test",
+		analytics.WithPrefix("app:"),
+		analytics.WithSink(s),
+	)
+
+	if err := a.Track("cool", a.Body("very", "nice")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(s.events))
+	}
+
+	if s.events[0].Event != "app:cool" {
+		t.Fatalf("unexpected event %q", s.events[0].Event)
+	}
+}
+
+type s3Client struct {
+	s3iface.S3API
+	fail   string // fail uploading keys containing this
+	keys   []string
+	bodies [][]byte
+}
+
+func (c *s3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if c.fail != "" && strings.Contains(*input.Key, c.fail) {
+		return nil, errors.New("slow down")
+	}
+	gz, err := gzip.NewReader(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	c.keys = append(c.keys, *input.Key)
+	c.bodies = append(c.bodies, body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3Sink(t *testing.T) {
+	home(t)
+	c := &s3Client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   &analytics.S3Sink{Client: c, Bucket: "bucket", Prefix: "events"},
+	})
+	a.TrackAt(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), "one", nil)
+	a.TrackAt(time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC), "two", nil)
+	a.TrackAt(time.Date(2020, 1, 2, 13, 0, 0, 0, time.UTC), "three", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// one object per day
+	if len(c.keys) != 2 || !strings.HasPrefix(c.keys[0], "events/dt=2020-01-01/") || !strings.HasPrefix(c.keys[1], "events/dt=2020-01-02/") || !strings.HasSuffix(c.keys[1], ".json.gz") {
+		t.Fatalf("unexpected keys %v", c.keys)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(c.bodies[1])), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events in the second object, got %q", c.bodies[1])
+	}
+
+	var event analytics.Event
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Event != "three" {
+		t.Fatalf("unexpected event %s", lines[1])
+	}
+
+	// only the days that failed are uploaded again
+	c.fail = "dt=2020-01-03/"
+	a.TrackAt(time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC), "four", nil)
+	a.TrackAt(time.Date(2020, 1, 4, 12, 0, 0, 0, time.UTC), "five", nil)
+
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+
+	if len(c.keys) != 3 || !strings.HasPrefix(c.keys[2], "events/dt=2020-01-04/") {
+		t.Fatalf("expected the other day to be uploaded, got %v", c.keys)
+	}
+
+	c.fail = ""
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := a.Size(); len(c.keys) != 4 || !strings.HasPrefix(c.keys[3], "events/dt=2020-01-03/") || n != 0 {
+		t.Fatalf("expected only the failed day to be uploaded, got %v", c.keys)
+	}
+}
+
+type sqsClient struct {
+	sqsiface.SQSAPI
+	fail    int // fail the second entry of this call
+	batches [][]*sqs.SendMessageBatchRequestEntry
+}
+
+func (c *sqsClient) SendMessageBatchWithContext(ctx aws.Context, input *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	c.batches = append(c.batches, input.Entries)
+	output := &sqs.SendMessageBatchOutput{}
+	if len(c.batches) == c.fail {
+		output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+			Id:      input.Entries[1].Id,
+			Message: aws.String("throttled"),
+		})
+	}
+	return output, nil
+}
+
+func TestSQSSink(t *testing.T) {
+	home(t)
+	c := &sqsClient{fail: 2}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   &analytics.SQSSink{Client: c, QueueURL: "https://sqs/queue"},
+	})
+	for i := 0; i < 25; i++ {
+		a.Track("cool", analytics.Body{"n": i})
+	}
+
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected a message to fail")
+	}
+
+	if len(c.batches) != 3 || len(c.batches[0]) != 10 || len(c.batches[2]) != 5 {
+		t.Fatalf("expected batches of up to 10 messages, got %d", len(c.batches))
+	}
+
+	// only the failed message is sent again
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var event analytics.Event
+	if len(c.batches) != 4 || len(c.batches[3]) != 1 {
+		t.Fatalf("expected the failed message to be resent alone, got %d batches", len(c.batches))
+	} else if err := json.Unmarshal([]byte(*c.batches[3][0].MessageBody), &event); err != nil || event.Body["n"] != float64(11) {
+		t.Fatalf("unexpected message %s", *c.batches[3][0].MessageBody)
+	}
+
+	// events over the message limit are split into parts
+	a.Track("big", analytics.Body{"data": strings.Repeat("x", 600*1024)})
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := c.batches[4:]
+	if len(parts) != 3 || *parts[2][0].MessageAttributes["parts"].StringValue != "3" || *parts[2][0].MessageAttributes["part"].StringValue != "3" {
+		t.Fatalf("expected the event to be split in 3 parts, got %d", len(parts))
+	}
+}
+
+func TestSegmentSink(t *testing.T) {
+	home(t)
+	var batches [][]map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, _, _ := r.BasicAuth(); key != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Batch []map[string]interface{} `json:"batch"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		batches = append(batches, body.Batch)
+	}))
+	defer srv.Close()
+
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   &analytics.SegmentSink{WriteKey: "key", Endpoint: srv.URL},
+	})
+	a.Identify("user", nil)
+	for i := 0; i < 3; i++ {
+		a.Track("cool", analytics.Body{"data": strings.Repeat("x", 200*1024)})
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// batches are kept under 500KB
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 {
+		t.Fatalf("unexpected batches %d", len(batches))
+	}
+
+	track := batches[1][0]
+	props, _ := track["properties"].(map[string]interface{})
+	if track["type"] != "track" || track["event"] != "cool" || track["userId"] != "user" || track["messageId"] == "" || props["data"] == nil {
+		t.Fatalf("unexpected track call %v", track["event"])
+	}
+
+	a.Track("cool", nil)
+	a.Sink = &analytics.SegmentSink{WriteKey: "wrong", Endpoint: srv.URL}
+	if err := a.Flush(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected the request to be rejected, got %v", err)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	dir := home(t)
+	var buf bytes.Buffer
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   &analytics.WriterSink{Writer: &buf},
+	})
+	a.Track("cool", analytics.Body{"n": 1})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var event analytics.Event
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil || event.Event != "cool" || !strings.Contains(buf.String(), `  "event": "cool"`) {
+		t.Fatalf("expected pretty-printed json, got %s", buf.String())
+	}
+
+	// files are appended to between flushes
+	path := dir + "/events.json"
+	a.Sink = &analytics.WriterSink{Path: path}
+	for i := 0; i < 2; i++ {
+		a.Track("cool", nil)
+		if err := a.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), `"event": "cool"`); n != 2 {
+		t.Fatalf("expected 2 events in the file, got %d", n)
+	}
+}
+
+// logsClient rejects puts without the latest sequence token.
+type logsClient struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	mu      sync.Mutex
+	token   int
+	batches [][]*cloudwatchlogs.InputLogEvent
+}
+
+func (c *logsClient) PutLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.PutLogEventsInput, opts ...request.Option) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.StringValue(input.SequenceToken) != strconv.Itoa(c.token) && c.token > 0 {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException, "invalid token", nil)
+	}
+
+	// give the other goroutines a chance to use a stale token
+	time.Sleep(time.Millisecond)
+
+	c.token++
+	c.batches = append(c.batches, input.LogEvents)
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(strconv.Itoa(c.token))}, nil
+}
+
+func TestCloudWatchSink(t *testing.T) {
+	c := &logsClient{}
+	s := &analytics.CloudWatchSink{Client: c, LogGroup: "group", LogStream: "stream"}
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	// batches can't span more than a day and must be in order
+	err := s.Send(context.Background(), []*analytics.Event{
+		{Event: "later", Timestamp: day.Add(25 * time.Hour).Format(time.RFC3339)},
+		{Event: "first", Timestamp: day.Format(time.RFC3339)},
+		{Event: "second", Timestamp: day.Add(time.Hour).Format(time.RFC3339)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.batches) != 2 || len(c.batches[0]) != 2 || !strings.Contains(*c.batches[0][0].Message, `"event":"first"`) || *c.batches[0][1].Timestamp != day.Add(time.Hour).UnixMilli() {
+		t.Fatalf("unexpected batches %v", c.batches)
+	}
+
+	// concurrent sends take turns with the sequence token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Send(context.Background(), []*analytics.Event{{Event: "cool", Timestamp: day.Format(time.RFC3339)}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(c.batches) != 12 {
+		t.Fatalf("expected 12 batches, got %d", len(c.batches))
+	}
+}
+
+type client struct {
+	firehoseiface.FirehoseAPI
+	failures int
+	calls    int
+	records  int
+	data     [][]byte
+	status   string
+	created  *firehose.CreateDeliveryStreamInput
+}
+
+func (c *client) CreateDeliveryStreamWithContext(ctx aws.Context, input *firehose.CreateDeliveryStreamInput, opts ...request.Option) (*firehose.CreateDeliveryStreamOutput, error) {
+	c.created = input
+	c.status = firehose.DeliveryStreamStatusActive
+	return &firehose.CreateDeliveryStreamOutput{}, nil
+}
+
+func (c *client) DescribeDeliveryStreamWithContext(ctx aws.Context, input *firehose.DescribeDeliveryStreamInput, opts ...request.Option) (*firehose.DescribeDeliveryStreamOutput, error) {
+	if c.status == "" {
+		return nil, awserr.New(firehose.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	return &firehose.DescribeDeliveryStreamOutput{
+		DeliveryStreamDescription: &firehose.DeliveryStreamDescription{
+			DeliveryStreamStatus: aws.String(c.status),
+		},
+	}, nil
+}
+
+// fail the first record of the first n calls
+func (c *client) PutRecordBatchWithContext(ctx aws.Context, input *firehose.PutRecordBatchInput, opts ...request.Option) (*firehose.PutRecordBatchOutput, error) {
+	c.calls++
+	c.records += len(input.Records)
+	output := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int64(0)}
+	for i, record := range input.Records {
+		c.data = append(c.data, record.Data)
+		res := &firehose.PutRecordBatchResponseEntry{}
+		if c.calls <= c.failures && i == 0 {
+			res.ErrorCode = aws.String("ServiceUnavailableException")
+			output.FailedPutCount = aws.Int64(1)
+		}
+		output.RequestResponses = append(output.RequestResponses, res)
+	}
+	return output, nil
+}
+
+func TestClient(t *testing.T) {
+	home(t)
+	c := &client{failures: 1}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Client: c,
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := a.Track("cool", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", c.calls)
+	}
+
+	if c.records != 4 {
+		t.Fatalf("expected 4 records sent, got %d", c.records)
+	}
+}
+
+// fakeAWS serves STS and Firehose, counting the calls by action.
+type fakeAWS struct {
+	mu    sync.Mutex
+	calls map[string]int
+	auth  string // auth header of the last request
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	action := r.Form.Get("Action")
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		action = target[strings.Index(target, ".")+1:]
+	}
+
+	f.mu.Lock()
+	f.calls[action]++
+	f.auth = r.Header.Get("Authorization")
+	f.mu.Unlock()
+
+	switch action {
+	case "AssumeRole":
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+			<AccessKeyId>id</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>
+			<SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>
+			</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	case "PutRecordBatch":
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		io.WriteString(w, `{"FailedPutCount":0,"RequestResponses":[{"RecordId":"1"}]}`)
+	default:
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		io.WriteString(w, `{}`)
+	}
+}
+
+// fakeSession serves AWS from a fake on a local endpoint.
+func fakeSession(t *testing.T) (*session.Session, *fakeAWS, string) {
+	f := &fakeAWS{calls: map[string]int{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-east-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sess, f, srv.URL
+}
+
+func TestAssumeRole(t *testing.T) {
+	home(t)
+	sess, f, _ := fakeSession(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Session: sess,
+		RoleARN: "arn:aws:iam::123456789012:role/analytics",
+	})
+
+	for i := 0; i < 3; i++ {
+		a.Track("cool", nil)
+		if err := a.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the client and its credentials are reused between flushes
+	if f.calls["AssumeRole"] != 1 || f.calls["PutRecordBatch"] != 3 {
+		t.Fatalf("expected the role to be assumed once, got %v", f.calls)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	home(t)
+	_, f, url := fakeSession(t)
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		Region:      aws.String("us-east-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:   "test",
+		Session:  sess,
+		Endpoint: url,
+		Region:   "eu-west-1",
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// sent to the endpoint, signed for the region
+	if f.calls["PutRecordBatch"] != 1 || !strings.Contains(f.auth, "/eu-west-1/firehose/") {
+		t.Fatalf("expected the overrides to be used, got %v %q", f.calls, f.auth)
+	}
+}
+
+func TestCreateStream(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		Client:       c,
+		CreateStream: true,
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err == nil || !strings.Contains(err.Error(), "no S3 destination") {
+		t.Fatalf("expected a missing destination, got %v", err)
+	}
+	a.Close()
+
+	c = &client{}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		Client:        c,
+		CreateStream:  true,
+		S3Destination: &firehose.ExtendedS3DestinationConfiguration{BucketARN: aws.String("arn:aws:s3:::bucket")},
+	})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.created == nil || *c.created.DeliveryStreamName != "test" || *c.created.ExtendedS3DestinationConfiguration.BucketARN != "arn:aws:s3:::bucket" {
+		t.Fatalf("expected the stream to be created, got %v", c.created)
+	}
+
+	if c.records != 1 {
+		t.Fatalf("expected the event to be sent once the stream is active, got %d", c.records)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	home(t)
+	c := &client{failures: 10}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Client: c,
+		Backoff: analytics.Backoff{
+			MaxAttempts: 2,
+			Min:         time.Millisecond,
+		},
+	})
+
+	if err := a.Track("cool", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if c.calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", c.calls)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Client: c,
+	})
+
+	for i := 0; i < 1200; i++ {
+		if err := a.Track("cool", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", c.calls)
+	}
+
+	if c.records != 1200 {
+		t.Fatalf("expected 1200 records sent, got %d", c.records)
+	}
+}
+
+func TestOversize(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		MaxEventSize: 512,
+		Oversize:     analytics.OversizeSplit,
+	})
+
+	if err := a.Track("big", a.Body("data", strings.Repeat("x", 2000))); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) < 4 {
+		t.Fatalf("expected the event to be split, got %d events", len(events))
+	}
+
+	for _, event := range events {
+		if event.Body["continuation"] == nil {
+			t.Fatalf("expected a continuation event, got %v", event.Body)
+		}
+	}
+}
+
+func TestOversizeTruncate(t *testing.T) {
+	home(t)
+	logs := memory.New()
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		MaxEventSize: 512,
+		Oversize:     analytics.OversizeTruncate,
+		Log:          &log.Logger{Handler: logs, Level: log.DebugLevel},
+	})
+
+	if err := a.Track("big", analytics.Body{"data": strings.Repeat("é", 1000), "plan": "pro", "truncated": "no"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected the event to be truncated, got %d events", len(events))
+	}
+
+	body := events[0].Body
+	data, _ := body["data"].(string)
+	if body["truncated"] != true || body["plan"] != "pro" || !strings.HasSuffix(data, "…") || !utf8.ValidString(data) {
+		t.Fatalf("expected the data to be shortened, got %v", body)
+	}
+
+	if b, _ := json.Marshal(events[0]); len(b) > 512 {
+		t.Fatalf("expected the event to fit, got %d bytes", len(b))
+	}
+
+	// events that can't be truncated to fit are dropped with a warning
+	if err := a.Track(strings.Repeat("x", 1000), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if size, _ := a.Size(); size != 1 {
+		t.Fatalf("expected the event to be dropped, got %d events", size)
+	}
+
+	last := logs.Entries[len(logs.Entries)-1]
+	if last.Message != "dropping oversized event" {
+		t.Fatalf("expected a drop warning, got %q", last.Message)
+	}
+}
+
+func TestOversizeMarshaler(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		Client:       c,
+		Marshaler:    &analytics.CloudEvents{Source: "myapp"},
+		MaxEventSize: 512,
+		Oversize:     analytics.OversizeSplit,
+	})
+
+	if err := a.Track("big", a.Body("data", strings.Repeat("x", 2000))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) < 4 {
+		t.Fatalf("expected the event to be split, got %d records", len(c.data))
+	}
+
+	// the envelope counts towards the size
+	for _, record := range c.data {
+		if len(record) > 512 {
+			t.Fatalf("expected records within the max size, got %d bytes", len(record))
+		}
+	}
+}
+
+func TestTrackNow(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+
+	if err := a.TrackNow("crash", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 {
+		t.Fatalf("expected 1 event sent, got %d", len(s.events))
+	}
+
+	// queue the event when the sink fails
+	s.err = errors.New("offline")
+	if err := a.TrackNow("crash", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := a.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 1 {
+		t.Fatalf("expected 1 event queued, got %d", size)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+
+	if err := a.Identify("matt", a.Body("plan", "pro")); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// traits are loaded by new instances
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+
+	if err := a.Track("cool", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	body := events[1].Body
+	if body["user_id"] != "matt" {
+		t.Fatalf("expected user_id, got %v", body)
+	}
+
+	if body["anonymous_id"] == nil {
+		t.Fatalf("expected anonymous_id, got %v", body)
+	}
+
+	traits, _ := body["traits"].(map[string]interface{})
+	if traits["plan"] != "pro" {
+		t.Fatalf("expected traits, got %v", body)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	dir := home(t)
+	a := analytics.New("test")
+	a.Track("first", nil)
+	old, _ := os.ReadFile(dir + "/config/test/id")
+
+	if err := a.Alias("", "new"); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if id, _ := os.ReadFile(dir + "/config/test/id"); string(id) != "new" || len(old) == 0 {
+		t.Fatalf("expected the new id to be saved, got %q", id)
+	}
+
+	// later runs use the new id
+	a = analytics.New("test")
+	defer a.Close()
+	a.Identify("user", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias := events[1]
+	if alias.Event != "alias" || alias.Body["previous_id"] != string(old) || alias.Body["user_id"] != "new" {
+		t.Fatalf("unexpected alias %v", alias.Body)
+	}
+
+	if events[2].Body["anonymous_id"] != "new" {
+		t.Fatalf("expected the new anonymous id, got %v", events[2].Body["anonymous_id"])
+	}
+}
+
+func TestGroup(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	if err := a.Group("org", analytics.Body{"plan": "team"}); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// the group is saved for later runs
+	a = analytics.New("test")
+	defer a.Close()
+	a.Track("cool", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traits, _ := events[0].Body["group_traits"].(map[string]interface{})
+	if events[0].Event != "group" || events[0].Body["group_id"] != "org" || traits["plan"] != "team" {
+		t.Fatalf("unexpected group event %v", events[0].Body)
+	}
+
+	if events[1].Body["group_id"] != "org" {
+		t.Fatalf("expected the group id on later events, got %v", events[1].Body)
+	}
+}
+
+type deploy struct {
+	Region string
+}
+
+func (d *deploy) EventName() string {
+	return "deploy"
+}
+
+func (d *deploy) EventBody() analytics.Body {
+	return analytics.Body{"region": d.Region}
+}
+
+func TestTrackEvent(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Prefix: "app:",
+		Stream: "test",
+	})
+
+	if err := a.TrackEvent(&deploy{Region: "us-west-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "app:deploy" || events[0].Body["region"] != "us-west-2" {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	home(t)
+	s := &sink{}
+	flushed := 0
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Middleware: []analytics.Middleware{
+			{
+				// drop debug events and redact emails
+				Track: func(next analytics.TrackFunc) analytics.TrackFunc {
+					return func(event *analytics.Event) error {
+						if event.Event == "debug" {
+							return nil
+						}
+						delete(event.Body, "email")
+						return next(event)
+					}
+				},
+				Flush: func(next analytics.FlushFunc) analytics.FlushFunc {
+					return func(ctx context.Context, events []*analytics.Event) error {
+						flushed += len(events)
+						return next(ctx, events)
+					}
+				},
+			},
+		},
+	})
+
+	a.Track("debug", nil)
+	a.Track("signup", a.Body("email", "matt@example.com"))
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if flushed != 1 || len(s.events) != 1 {
+		t.Fatalf("expected 1 event flushed, got %d", len(s.events))
+	}
+
+	if s.events[0].Body["email"] != nil {
+		t.Fatalf("expected email to be redacted, got %v", s.events[0].Body)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Prefix: "app:",
+		Sink:   s,
+		Filters: []analytics.Filter{
+			func(event *analytics.Event) bool { return event.Event != "app:secret" },
+			func(event *analytics.Event) bool { return event.Body["internal"] == nil },
+		},
+	})
+
+	a.Track("one", nil)
+	a.Track("secret", nil)
+	a.Track("two", analytics.Body{"internal": true})
+	a.TrackNow("secret", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "app:one" || len(s.events) != 0 {
+		t.Fatalf("expected the filtered events to be dropped, got %v", events)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	defer a.Close()
+
+	timer := a.StartTimer("build")
+	time.Sleep(20 * time.Millisecond)
+	if err := timer.Stop(analytics.Body{"target": "linux"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms, _ := events[0].Body["duration_ms"].(float64)
+	if events[0].Event != "build" || events[0].Body["target"] != "linux" || ms < 20 {
+		t.Fatalf("unexpected timing %v", events[0].Body)
+	}
+}
+
+func TestSample(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Prefix:      "app:",
+		Stream:      "test",
+		SampleRate:  0.5,
+		SampleRates: map[string]float64{"never": 0, "always": 1},
+	})
+
+	for i := 0; i < 100; i++ {
+		a.Track("never", nil)
+		a.Track("always", nil)
+		a.Track("sometimes", nil)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, event := range events {
+		counts[event.Event]++
+		if event.Event == "app:sometimes" && event.Body["sample_rate"] != 0.5 {
+			t.Fatalf("expected sample_rate, got %v", event.Body)
+		}
+	}
+
+	if counts["app:never"] != 0 || counts["app:always"] != 100 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	if counts["app:sometimes"] == 0 || counts["app:sometimes"] == 100 {
+		t.Fatalf("expected some events to be sampled, got %d", counts["app:sometimes"])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+	a.Count("builds", 2)
+	a.Close()
+
+	s := &sink{}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+	a.Count("builds", 3)
+	a.Gauge("cache_mb", 12.5)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 || s.events[0].Event != "metrics" {
+		t.Fatalf("expected a metrics event, got %v", s.events)
+	}
+
+	counters, _ := s.events[0].Body["counters"].(map[string]interface{})
+	if counters["builds"] != float64(5) {
+		t.Fatalf("expected builds to be 5, got %v", counters["builds"])
+	}
+}
+
+func TestMetricsFilter(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Filters: []analytics.Filter{
+			func(event *analytics.Event) bool { return event.Event != "metrics" },
+		},
+	})
+	defer a.Close()
+	a.Count("builds", 1)
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 || s.events[0].Event != "cool" {
+		t.Fatalf("expected the metrics to be filtered, got %v", s.events)
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	home(t)
+	var results []analytics.FlushResult
+	var errs []error
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Sink:    &sink{err: errors.New("offline")},
+		OnFlush: func(result analytics.FlushResult) { results = append(results, result) },
+		OnError: func(err error) { errs = append(errs, err) },
+	})
+
+	a.Track("cool", nil)
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(results) != 1 || results[0].Events != 1 || results[0].Err == nil {
+		t.Fatalf("unexpected results %v", results)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+}
+
+func TestWith(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+	a.Set(a.Body("version", "1.0.0"))
+
+	deploy := a.With(a.Body("component", "deploy"))
+	deploy.Track("start", nil)
+	a.Track("done", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	if events[0].Body["component"] != "deploy" || events[0].Body["version"] != "1.0.0" {
+		t.Fatalf("expected scoped and global fields, got %v", events[0].Body)
+	}
+
+	if events[1].Body["component"] != nil {
+		t.Fatalf("expected no scoped fields, got %v", events[1].Body)
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Enrich:  true,
+		Version: "1.2.0",
+	})
+	a.Track("start", analytics.Body{"os": "custom"})
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := events[0].Body
+	if body["arch"] != runtime.GOARCH || body["go_version"] != runtime.Version() {
+		t.Fatalf("expected the environment, got %v", body)
+	}
+
+	if body["os"] != "custom" {
+		t.Fatalf("expected the event's own fields to win, got %v", body["os"])
+	}
+
+	if _, ok := body["terminal"]; !ok {
+		t.Fatalf("expected the terminal flag, got %v", body)
+	}
+}
+
+func TestLocale(t *testing.T) {
+	home(t)
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MESSAGES", "")
+	t.Setenv("LANG", "de_DE.UTF-8")
+
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Locale: true,
+	})
+	a.Track("start", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := events[0].Body
+	if body["locale"] != "de_DE" || body["tz_offset"] == nil || body["time_of_day"] == nil {
+		t.Fatalf("expected the locale and time, got %v", body)
+	}
+}
+
+func TestMachineID(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		MachineSalt: "salt",
+	})
+	a.Track("start", nil)
+
+	b := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "other",
+		MachineSalt: "salt",
+	})
+	b.Track("start", nil)
+
+	ae, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be, err := b.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := ae[0].Body["machine_id"].(string)
+	if len(id) != 64 || be[0].Body["machine_id"] != id {
+		t.Fatalf("expected the same machine id, got %v and %v", ae[0].Body, be[0].Body)
+	}
+
+	if host, _ := os.Hostname(); host != "" && strings.Contains(id, host) {
+		t.Fatal("expected the hostname to be hashed")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Version: "1.2.0",
+	})
+	a.Track("start", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := events[0].Body
+	if body["app_version"] != "1.2.0" || body["analytics_lib_version"] == nil {
+		t.Fatalf("expected the versions, got %v", body)
+	}
+}
+
+func TestTrackAt(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	a.TrackAt(at, "imported", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if events[0].Timestamp != "2020-01-02T03:04:05Z" {
+		t.Fatalf("expected the given timestamp, got %s", events[0].Timestamp)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	home(t)
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+	nano := analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Timestamps: analytics.TimestampNano,
+	})
+	nano.TrackAt(at, "nano", nil)
+
+	millis := analytics.NewFromConfig(&analytics.Config{
+		Stream:     "other",
+		Timestamps: analytics.TimestampMillis,
+	})
+	millis.TrackAt(at, "millis", nil)
+
+	events, err := nano.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Timestamp != "2020-01-02T03:04:05.006Z" {
+		t.Fatalf("unexpected timestamp %s", events[0].Timestamp)
+	}
+
+	events, err = millis.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Timestamp != "1577934245006" {
+		t.Fatalf("unexpected timestamp %s", events[0].Timestamp)
+	}
+}
+
+func TestRestrictedFields(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		AllowedFields: []string{"plan", "email"},
+		DeniedFields:  []string{"email"},
+	})
+	a.Set(a.Body("debug", true))
+	a.Track("signup", analytics.Body{"plan": "pro", "email": "a@b.c", "password": "x"})
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := events[0].Body
+	if body["plan"] != "pro" || body["email"] != nil || body["password"] != nil || body["debug"] != nil {
+		t.Fatalf("expected only the allowed fields, got %v", body)
+	}
+
+	if body["session_id"] == nil {
+		t.Fatalf("expected the library's fields, got %v", body)
+	}
+}
+
+func TestHashIdentifiers(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		HashSalt:    "salt",
+		Identifiers: []string{"email"},
+	})
+	a.Identify("user-1", nil)
+	a.Track("signup", analytics.Body{"email": "a@b.c", "plan": "pro"})
+	a.Track("login", analytics.Body{"email": "a@b.c"})
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signup, login := events[1].Body, events[2].Body
+	if signup["user_id"] == "user-1" || signup["email"] == "a@b.c" || signup["plan"] != "pro" {
+		t.Fatalf("expected hashed identifiers, got %v", signup)
+	}
+
+	if signup["email"] != login["email"] || signup["user_id"] != login["user_id"] {
+		t.Fatal("expected the hashes to stay the same per user")
+	}
+}
+
+func TestConsent(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	if err := a.SetConsent(analytics.ConsentErrors); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Track("usage", nil)
+	a.TrackTier(analytics.ConsentErrors, "crash", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "crash" {
+		t.Fatalf("expected only the error, got %v", events)
+	}
+
+	// persisted for the next run
+	b := analytics.New("test")
+	if c, err := b.Consent(); err != nil || c != analytics.ConsentErrors {
+		t.Fatalf("expected errors, got %s %v", c, err)
+	}
+
+	if err := b.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	b.TrackTier(analytics.ConsentErrors, "crash", nil)
+
+	if n, _ := b.Size(); n != 1 {
+		t.Fatalf("expected nothing tracked once off, got %d", n)
+	}
+}
+
+func TestConsentWhileTracking(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	defer a.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			a.Track("usage", nil)
+			a.Count("calls", 1)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		a.SetConsent(analytics.ConsentErrors)
+		a.SetConsent(analytics.ConsentFull)
+	}
+	a.Disable()
+	<-done
+
+	if err := a.Track("usage", nil); err != nil || a.Lifecycle() != analytics.LifecycleDisabled {
+		t.Fatalf("expected to be disabled, got %s %v", a.Lifecycle(), err)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.SessionID() == "" || events[0].Body["session_id"] != a.SessionID() || events[1].Body["session_id"] != a.SessionID() {
+		t.Fatalf("expected the session on every event, got %v", events)
+	}
+
+	b := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+	if b.SessionID() == a.SessionID() {
+		t.Fatal("expected a new session per instance")
+	}
+}
+
+func TestConcurrentTrack(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				a.Set(analytics.Body{"worker": i})
+				a.Track("tick", analytics.Body{"n": j})
+				a.Count("ticks", 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 200 {
+		t.Fatalf("expected 200 events, got %d", len(events))
+	}
+
+	seen := map[uint64]bool{}
+	for _, e := range events {
+		if seen[e.Seq] {
+			t.Fatalf("duplicate seq %d", e.Seq)
+		}
+		seen[e.Seq] = true
+	}
+}
+
+func TestSeq(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+	a.Track("one", nil)
+	a.Close()
+
+	// the sequence carries on across runs
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+	})
+	a.Track("two", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Seq != 1 || events[1].Seq != 2 {
+		t.Fatalf("unexpected sequence numbers %v", events)
+	}
+}
+
+func TestSeqShared(t *testing.T) {
+	home(t)
+
+	// two processes sharing the dir at once
+	a := analytics.NewFromConfig(&analytics.Config{Stream: "test"})
+	b := analytics.NewFromConfig(&analytics.Config{Stream: "test"})
+
+	for i := 0; i < 3; i++ {
+		a.Track("a", nil)
+		b.Track("b", nil)
+	}
+	b.Close()
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if len(events) != 6 {
+		t.Fatalf("expected 6 events, got %d", len(events))
+	}
+
+	seen := map[uint64]bool{}
+	for _, e := range events {
+		if seen[e.Seq] {
+			t.Fatalf("duplicate seq %d", e.Seq)
+		}
+		seen[e.Seq] = true
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+
+	if err := a.SetEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+	a.Track("ignored", nil)
+
+	enabled, err := a.Enabled()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enabled {
+		t.Fatal("expected the opt-out to be saved")
+	}
+
+	if err := a.SetEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+	a.Track("tracked", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "tracked" {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestDoNotTrack(t *testing.T) {
+	home(t)
+	t.Setenv("DO_NOT_TRACK", "1")
+	a := analytics.New("test")
+
+	enabled, err := a.Enabled()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enabled {
+		t.Fatal("expected DO_NOT_TRACK to disable tracking")
+	}
+
+	// the env var overrides the disable file
+	t.Setenv("DO_NOT_TRACK", "")
+	t.Setenv("TEST_ANALYTICS", "1")
+	a.Disable()
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		EnvVar: "TEST_ANALYTICS",
+	})
+
+	if enabled, _ := a.Enabled(); !enabled {
+		t.Fatal("expected TEST_ANALYTICS to enable tracking")
+	}
+}
+
+func TestCI(t *testing.T) {
+	home(t)
+	for _, key := range []string{"CI", "CONTINUOUS_INTEGRATION", "BUILD_NUMBER", "GITHUB_ACTIONS", "GITLAB_CI", "CIRCLECI", "TRAVIS", "BUILDKITE", "JENKINS_URL", "TEAMCITY_VERSION", "TF_BUILD", "BITBUCKET_BUILD_NUMBER", "CODEBUILD_BUILD_ID", "DRONE", "APPVEYOR"} {
+		t.Setenv(key, "")
+	}
+
+	track := func(policy analytics.CIPolicy) []*analytics.Event {
+		a := analytics.NewFromConfig(&analytics.Config{Stream: "test", CI: policy, Memory: true})
+		defer a.Close()
+		a.Track("cool", nil)
+		events, err := a.Events()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+
+	t.Setenv("CI", "false")
+	if events := track(analytics.CITag); events[0].Body["ci"] != nil {
+		t.Fatalf("expected CI=false not to be CI, got %v", events[0].Body)
+	}
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	if events := track(analytics.CITag); events[0].Body["ci"] != true {
+		t.Fatalf("expected the event to be tagged, got %v", events[0].Body)
+	}
+
+	if events := track(analytics.CIIgnore); events[0].Body["ci"] != nil {
+		t.Fatalf("expected CI to be ignored, got %v", events[0].Body)
+	}
+
+	if events := track(analytics.CISuppress); len(events) != 0 {
+		t.Fatalf("expected nothing to be tracked in CI, got %d", len(events))
+	}
+}
+
+func TestMemory(t *testing.T) {
+	dir := home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Memory: true,
+	})
+	a.Identify("user", nil)
+	a.Track("one", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if len(s.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(s.events))
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+		t.Fatal("expected nothing to be written to disk")
+	}
+}
+
+// testStore checks the behavior every Store shares, closing it.
+func testStore(t *testing.T, store analytics.Store) {
+	t.Helper()
+	home(t)
+
+	if n, err := store.Size(); err != nil || n != 0 {
+		t.Fatalf("expected an empty store, got %d %v", n, err)
+	}
+
+	store.Append(&analytics.Event{ID: "1", Event: "a", Body: analytics.Body{"n": 1.0}})
+	store.Append(&analytics.Event{ID: "2", Event: "b"}, &analytics.Event{ID: "3", Event: "c"})
+
+	events, err := store.ReadBatch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != "1" || events[0].Body["n"] != 1.0 || events[1].Event != "b" {
+		t.Fatalf("expected the oldest events, got %v", events)
+	}
+
+	// reading doesn't remove anything
+	if n, _ := store.Size(); n != 3 {
+		t.Fatalf("expected 3 events, got %d", n)
+	}
+
+	if err := store.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := store.ReadBatch(0); len(events) != 1 || events[0].Event != "c" {
+		t.Fatalf("expected the oldest events to be removed, got %v", events)
+	}
+
+	if err := store.Remove(5); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := store.Size(); n != 0 {
+		t.Fatalf("expected the store to be empty, got %d", n)
+	}
+
+	// flushing through the store
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Store:  store,
+	})
+	defer a.Close()
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := store.Size(); n != 0 || len(s.events) != 2 || s.events[1].Event != "two" {
+		t.Fatalf("expected the events to be sent in order and removed, got %d queued", n)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, &analytics.MemoryStore{})
+}
+
+func TestMemoryStoreFlush(t *testing.T) {
+	home(t)
+	store := &analytics.MemoryStore{}
+	s := &sink{err: errors.New("offline")}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Store:  store,
+	})
+	for _, name := range []string{"one", "two", "three"} {
+		a.Track(name, nil)
+	}
+
+	// failed flushes keep the events queued
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if n, _ := store.Size(); n != 3 {
+		t.Fatalf("expected 3 queued events, got %d", n)
+	}
+
+	s.err = nil
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := store.Size(); n != 0 || len(s.events) != 3 || s.events[0].Event != "one" {
+		t.Fatalf("expected the events to be sent in order and removed, got %d queued", n)
+	}
+}
+
+func TestSharedQueue(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.New("test")
+	b := analytics.New("test", analytics.WithSink(s))
+
+	a.Track("one", nil)
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a's appends need to follow the queue b flushed
+	a.Track("two", nil)
+
+	events, err := b.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 || len(events) != 1 || events[0].Event != "two" {
+		t.Fatalf("unexpected events %v %v", s.events, events)
+	}
+}
+
+func TestFlushRotation(t *testing.T) {
+	home(t)
+	s := &sink{}
+	b := analytics.New("test")
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Middleware: []analytics.Middleware{
+			{
+				// another process tracks while we're sending
+				Flush: func(next analytics.FlushFunc) analytics.FlushFunc {
+					return func(ctx context.Context, events []*analytics.Event) error {
+						b.Track("during", nil)
+						return next(ctx, events)
+					}
+				},
+			},
+		},
+	})
+
+	a.Track("before", nil)
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 || len(events) != 1 || events[0].Event != "during" {
+		t.Fatalf("unexpected events %v %v", s.events, events)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	home(t)
+	s := &sink{}
+	batches := 0
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		SegmentSize: 1,
+		Middleware: []analytics.Middleware{
+			{
+				Flush: func(next analytics.FlushFunc) analytics.FlushFunc {
+					return func(ctx context.Context, events []*analytics.Event) error {
+						batches++
+						return next(ctx, events)
+					}
+				},
+			},
+		},
+	})
+
+	// every event ends up in its own segment
+	a.Track("one", nil)
+	a.Track("two", nil)
+	a.Track("three", nil)
+
+	if n, _ := a.Size(); n != 3 {
+		t.Fatalf("expected 3 events, got %d", n)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if batches != 3 || len(s.events) != 3 || s.events[0].Event != "one" || s.events[2].Event != "three" {
+		t.Fatalf("unexpected batches %d of %v", batches, s.events)
+	}
+
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected no events, got %d", n)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:         "test",
+		MaxQueueEvents: 2,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+	a.Track("three", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Event != "two" || events[1].Event != "three" {
+		t.Fatalf("expected the oldest event to be evicted, got %v", events)
+	}
+
+	home(t)
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:         "test",
+		MaxQueueEvents: 2,
+		Eviction:       analytics.EvictNewest,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+	a.Track("three", nil)
+
+	events, err = a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Event != "one" || events[1].Event != "two" {
+		t.Fatalf("expected the newest event to be dropped, got %v", events)
+	}
+
+	// corrupt lines aren't counted as evicted events
+	dir := home(t)
+	os.MkdirAll(dir+"/state/test", 0700)
+	os.WriteFile(dir+"/state/test/events", []byte("x\nx\nx\n"), 0600)
+	a = analytics.New("test")
+	for _, name := range []string{"one", "two", "three"} {
+		a.Track(name, nil)
+	}
+	a.Close()
+
+	info, err := os.Stat(dir + "/state/test/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		MaxQueueSize: info.Size(),
+	})
+	a.Track("four", nil)
+
+	events, err = a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 || events[0].Event != "two" {
+		t.Fatalf("expected only the oldest event to be evicted, got %v", events)
+	}
+}
+
+func TestSyncEvery(t *testing.T) {
+	home(t)
+	var syncs int
+	defer analytics.CountSyncs(&syncs)()
+
+	config := &analytics.Config{
+		Stream:    "test",
+		SyncEvery: 2,
+	}
+	a := analytics.NewFromConfig(config)
+	for i := 0; i < 5; i++ {
+		a.Track("cool", nil)
+	}
+
+	if syncs != 2 {
+		t.Fatalf("expected a sync every 2 events, got %d", syncs)
+	}
+
+	// the rest are synced on close
+	a.Close()
+	if syncs != 3 {
+		t.Fatalf("expected the last event to be synced, got %d", syncs)
+	}
+
+	a = analytics.NewFromConfig(config)
+	defer a.Close()
+	if n, _ := a.Size(); n != 5 {
+		t.Fatalf("expected 5 events, got %d", n)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		SegmentSize: 1,
+		Compress:    true,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Event != "one" || events[1].Event != "two" {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(s.events))
+	}
+
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected no events, got %d", n)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := home(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		EncryptionKey: key,
+	})
+	a.Identify("user", analytics.Body{"email": "matt@example.com"})
+	a.Track("signup", nil)
+	a.Close()
+
+	for _, path := range []string{"state/test/events", "config/test/traits"} {
+		b, err := os.ReadFile(dir + "/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(b), "matt@example.com") || strings.Contains(string(b), "signup") {
+			t.Fatalf("expected %s to be encrypted, got %s", path, b)
+		}
+	}
+
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		EncryptionKey: key,
+	})
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[1].Event != "signup" || events[1].Body["user_id"] != "user" {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestEncryptionNonce(t *testing.T) {
+	home(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	// a nonce can start like a plaintext file
+	defer analytics.SetRandom(bytes.NewReader(bytes.Repeat([]byte("{"), 1024)))()
+
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		EncryptionKey: key,
+	})
+	a.Identify("user", analytics.Body{"email": "matt@example.com"})
+	a.Close()
+
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		EncryptionKey: key,
+	})
+	defer a.Close()
+	a.Track("signup", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[1].Body["user_id"] != "user" {
+		t.Fatalf("expected the traits to be decrypted, got %v", events)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	dir := home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		KeepCorrupt: true,
+	})
+	a.Track("one", nil)
+	a.Close()
+
+	// a crash cut the last event short
+	f, err := os.OpenFile(dir+"/state/test/events", os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"event":"tw`)
+	f.Close()
+
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		KeepCorrupt: true,
+	})
+	a.Track("three", nil)
+
+	if n, err := a.Size(); err != nil || n != 2 {
+		t.Fatalf("expected 2 events, got %d: %v", n, err)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 2 || s.events[1].Event != "three" {
+		t.Fatalf("unexpected events %v", s.events)
+	}
+
+	b, err := os.ReadFile(dir + "/state/test/corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), `"event":"tw`) {
+		t.Fatalf("expected the corrupt event to be kept, got %s", b)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+	a.Close()
+
+	path := dir + "/state/test/events"
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(b), "#") {
+		t.Fatalf("expected a checksummed record, got %s", b)
+	}
+
+	// flip a byte in the first record
+	b = bytes.Replace(b, []byte(`"one"`), []byte(`"eno"`), 1)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 || s.events[0].Event != "two" {
+		t.Fatalf("unexpected events %v", s.events)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	dir := home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		WriteBuffer: 4096,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	if _, err := os.Stat(dir + "/state/test/events"); !os.IsNotExist(err) {
+		t.Fatal("expected the events to be buffered")
+	}
+
+	if n, err := a.Size(); err != nil || n != 2 {
+		t.Fatalf("expected 2 events, got %d: %v", n, err)
+	}
+
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(dir + "/state/test/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Fatalf("expected 2 events written, got %d", n)
+	}
+
+	a.Track("three", nil)
+	a.Close()
+
+	events, err := analytics.New("test").Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+}
+
+func TestLazyInit(t *testing.T) {
+	dir := home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+
+	if n, err := a.Size(); err != nil || n != 0 {
+		t.Fatalf("expected no events, got %d: %v", n, err)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.MaybeFlush(10, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{dir + "/config", dir + "/state"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be created", path)
+		}
+	}
+
+	a = analytics.New("test")
+	a.Track("one", nil)
+	a.Close()
+
+	if _, err := os.Stat(dir + "/config/test/id"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	dir := home(t)
+	a := analytics.New("test")
+	a.Track("one", nil)
+	a.Close()
+
+	for path, mode := range map[string]os.FileMode{"config/test": 0700, "config/test/id": 0600, "state/test/events": 0600} {
+		info, err := os.Stat(dir + "/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != mode {
+			t.Fatalf("expected %s to be %v, got %v", path, mode, info.Mode().Perm())
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	home(t)
+	dir := t.TempDir() + "/state"
+	a := analytics.New("test", analytics.WithPath(dir))
+	a.Track("one", nil)
+	a.Close()
+
+	if _, err := os.Stat(dir + "/events"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	dir := home(t)
+
+	// other platforms use the user config dir
+	p, err := analytics.ConfigPath("freebsd", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != dir+"/config/app" {
+		t.Fatalf("unexpected path %s", p)
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", dir)
+	if p, _ := analytics.ConfigPath("openbsd", "app"); p != dir+"/.config/app" {
+		t.Fatalf("expected to fall back to ~/.config, got %s", p)
+	}
+}
+
+func TestStreamDirs(t *testing.T) {
+	dir := home(t)
+
+	// older versions kept the id directly in the shared dir
+	os.MkdirAll(dir+"/config/app", 0700)
+	os.WriteFile(dir+"/config/app/id", []byte("old"), 0600)
+
+	one := analytics.New("one", analytics.WithDir("app"))
+	one.Track("a", nil)
+	one.Close()
+
+	two := analytics.New("two", analytics.WithDir("app"))
+	two.ResetID()
+	two.Close()
+
+	if _, err := os.Stat(dir + "/state/app/one/events"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := os.ReadFile(dir + "/config/app/one/id")
+	b, _ := os.ReadFile(dir + "/config/app/two/id")
+	if string(a) != "old" || string(b) == "old" || len(b) == 0 {
+		t.Fatalf("expected isolated ids, got %q and %q", a, b)
+	}
+
+	three := analytics.New("three", analytics.WithDir("app"), analytics.WithSharedID())
+	three.ResetID()
+	three.Close()
+
+	shared, _ := os.ReadFile(dir + "/config/app/id")
+	if string(shared) == "old" || len(shared) == 0 {
+		t.Fatalf("expected the shared id to be reset, got %q", shared)
+	}
+}
+
+func TestResetID(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	a.Identify("user", analytics.Body{"email": "a@b.c"})
+	a.Group("org", nil)
+
+	if _, err := a.ResetID(); err != nil {
+		t.Fatal(err)
+	}
+	a.Track("after", nil)
+	a.Close()
+
+	// the reset is saved, so later runs are anonymous too
+	a = analytics.New("test")
+	defer a.Close()
+	a.Track("later", nil)
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range events[len(events)-2:] {
+		for _, key := range []string{"user_id", "traits", "group_id"} {
+			if e.Body[key] != nil {
+				t.Fatalf("expected %s to be reset on %s, got %v", key, e.Event, e.Body[key])
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := home(t)
+
+	old := analytics.New("old")
+	old.Track("one", nil)
+	old.Disable()
+	old.Close()
+	id, _ := os.ReadFile(dir + "/config/old/id")
+
+	a := analytics.New("new")
+	if err := a.Migrate("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := os.ReadFile(dir + "/config/new/id"); string(b) != string(id) {
+		t.Fatalf("expected id %q, got %q", id, b)
+	}
+
+	if enabled, _ := a.Enabled(); enabled {
+		t.Fatal("expected the opt-out to be kept")
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "one" {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	if _, err := os.Stat(dir + "/config/old"); !os.IsNotExist(err) {
+		t.Fatal("expected the old dir to be removed")
+	}
+}
+
+func TestMigrateShared(t *testing.T) {
+	dir := home(t)
+
+	a := analytics.New("new")
+	for _, old := range []string{"", ".", "/tmp", "..", "old/../../other"} {
+		if err := a.Migrate(old); err == nil {
+			t.Fatalf("expected %q to be rejected", old)
+		}
+	}
+	a.Close()
+
+	one := analytics.New("one", analytics.WithDir("app"))
+	one.Track("a", nil)
+	one.Close()
+
+	two := analytics.New("two", analytics.WithDir("app"))
+	two.Track("b", nil)
+	two.Close()
+
+	// only this stream's files are moved out of the shared dir
+	a = analytics.New("one")
+	if err := a.Migrate("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if len(events) != 1 || events[0].Event != "a" {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	if _, err := os.Stat(dir + "/config/app/one"); !os.IsNotExist(err) {
+		t.Fatal("expected the stream's dir to be removed")
+	}
+
+	two = analytics.New("two", analytics.WithDir("app"))
+	defer two.Close()
+	events, err = two.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "b" {
+		t.Fatalf("expected the other stream's events to be kept, got %v", events)
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	dir := home(t)
+
+	// older versions kept the events with the config
+	os.MkdirAll(dir+"/config/test", 0700)
+	os.WriteFile(dir+"/config/test/events", []byte(`{"event":"old"}`+"\n"), 0600)
+
+	a := analytics.New("test")
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Event != "old" {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	if _, err := os.Stat(dir + "/config/test/events"); !os.IsNotExist(err) {
+		t.Fatal("expected the events to be moved")
+	}
+}
+
+func TestMaxEventAge(t *testing.T) {
+	home(t)
+	s := &sink{}
+	config := &analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		MaxEventAge: time.Hour,
+		Middleware: []analytics.Middleware{
+			{
+				// backdate the "old" event
+				Track: func(next analytics.TrackFunc) analytics.TrackFunc {
+					return func(event *analytics.Event) error {
+						if event.Event == "old" {
+							event.Timestamp = time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+						}
+						return next(event)
+					}
+				},
+			},
+		},
+	}
+
+	a := analytics.NewFromConfig(config)
+	a.Track("old", nil)
+	a.Track("new", nil)
+	a.Track("old", nil)
+	a.Close()
+
+	// the leading expired event is removed on init
+	a = analytics.NewFromConfig(config)
+	if n, _ := a.Size(); n != 2 {
+		t.Fatalf("expected 2 events, got %d", n)
+	}
+
+	// the rest are dropped when flushing
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 || s.events[0].Event != "new" {
+		t.Fatalf("unexpected events %v", s.events)
+	}
+
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected no events, got %d", n)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir := home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Sink:    &sink{},
+		Archive: 2,
+	})
+
+	for i := 0; i < 3; i++ {
+		a.Track("event", nil)
+		if err := a.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir + "/state/test/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected the last 2 batches, got %d", len(entries))
+	}
+}
+
+func TestStreamingFlush(t *testing.T) {
+	home(t)
+	s := &sink{}
+	batches := 0
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+		Middleware: []analytics.Middleware{
+			{
+				// the second batch fails once
+				Flush: func(next analytics.FlushFunc) analytics.FlushFunc {
+					return func(ctx context.Context, events []*analytics.Event) error {
+						batches++
+						if batches == 2 {
+							return errors.New("boom")
+						}
+						return next(ctx, events)
+					}
+				},
+			},
+		},
+	})
+
+	for i := 0; i < 700; i++ {
+		a.Track("cool", nil)
+	}
+
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(s.events) != 500 {
+		t.Fatalf("expected a batch of 500 events, got %d", len(s.events))
+	}
+
+	// the first batch isn't sent again
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 700 {
+		t.Fatalf("expected 700 events, got %d", len(s.events))
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	home(t)
+	s := &sink{err: errors.New("poison")}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		MaxAttempts: 2,
+	})
+	a.Track("poison", nil)
+
+	for i := 0; i < 2; i++ {
+		if err := a.Flush(); err == nil {
+			t.Fatal("expected the flush to fail")
+		}
+	}
+
+	dead, err := a.DeadLetter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Event != "poison" {
+		t.Fatalf("expected the event to be dead-lettered, got %v", dead)
+	}
+
+	// delivery carries on past the dead letter
+	s.err = nil
+	a.Track("fine", nil)
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.events) != 1 || s.events[0].Event != "fine" {
+		t.Fatalf("expected only the good event, got %v", s.events)
+	}
+
+	if err := a.RetryDeadLetter(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.events) != 2 || s.events[1].Event != "poison" {
+		t.Fatalf("expected the dead letter to be retried, got %v", s.events)
+	}
+
+	if dead, _ := a.DeadLetter(); len(dead) != 0 {
+		t.Fatalf("expected no dead letters, got %d", len(dead))
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	home(t)
+	s := &sink{err: errors.New("offline")}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Sink:    s,
+		Breaker: 2,
+	})
+	a.Track("cool", nil)
+
+	for i := 0; i < 2; i++ {
+		if err := a.Flush(); err == nil {
+			t.Fatal("expected the flush to fail")
+		}
+	}
+
+	// the network isn't tried again until the cool-down
+	s.err = nil
+	if err := a.Flush(); err != analytics.ErrBreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+	if len(s.events) != 0 {
+		t.Fatalf("expected nothing sent, got %d", len(s.events))
+	}
+	a.Close()
+
+	// the breaker is persisted between runs
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:   "test",
+		Sink:     s,
+		Breaker:  2,
+		Cooldown: time.Second,
+	})
+	defer a.Close()
+
+	if err := a.Flush(); err != analytics.ErrBreakerOpen {
+		t.Fatalf("expected the breaker to stay open, got %v", err)
+	}
+
+	time.Sleep(time.Second)
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.events) != 1 {
+		t.Fatalf("expected the event to be sent after the cool-down, got %d", len(s.events))
+	}
+
+	// flushes that give up don't count
+	s.err = context.DeadlineExceeded
+	a.Track("cool", nil)
+	for i := 0; i < 2; i++ {
+		if err := a.Flush(); err == nil {
+			t.Fatal("expected the flush to time out")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.FlushContext(ctx)
+
+	s.err = nil
+	if err := a.Flush(); err != nil {
+		t.Fatalf("expected the breaker to stay closed, got %v", err)
+	}
+}
+
+// waitSink blocks until the context is done
+type waitSink struct{}
+
+func (waitSink) Send(ctx context.Context, events []*analytics.Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFlushContext(t *testing.T) {
+	home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   waitSink{},
+	})
+	defer a.Close()
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.FlushContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the flush to time out, got %v", err)
+	}
+
+	if n, _ := a.Size(); n != 2 {
+		t.Fatalf("expected the events to stay queued, got %d", n)
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	home(t)
+	config := &analytics.Config{
+		Stream:       "test",
+		Sink:         waitSink{},
+		FlushOnClose: true,
+	}
+	a := analytics.NewFromConfig(config)
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.CloseContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config.FlushOnClose = false
+	a = analytics.NewFromConfig(config)
+	defer a.Close()
+	if n, _ := a.Size(); n != 2 {
+		t.Fatalf("expected the events to stay queued, got %d", n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+	a.Track("one", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 {
+		t.Fatalf("expected the events to be flushed, got %d", len(s.events))
+	}
+
+	if err := a.Track("two", nil); err != analytics.ErrClosed {
+		t.Fatalf("expected tracking to fail once shut down, got %v", err)
+	}
+}
+
+func TestShutdownWhileTracking(t *testing.T) {
+	home(t)
+	s := &sink{}
+	config := &analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	}
+	a := analytics.NewFromConfig(config)
+
+	var wg sync.WaitGroup
+	tracked := make([]int, 4)
+	for i := range tracked {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				err := a.Track("cool", nil)
+				if err == analytics.ErrClosed {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				tracked[i]++
+			}
+		}(i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// every event is either sent or still queued
+	a = analytics.NewFromConfig(config)
+	defer a.Close()
+	queued, _ := a.Size()
+
+	total := 0
+	for _, n := range tracked {
+		total += n
+	}
+
+	if total == 0 || len(s.events)+queued != total {
+		t.Fatalf("expected %d events, got %d sent and %d queued", total, len(s.events), queued)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	home(t)
+	configs := map[string]*analytics.Config{
+		"stream":      {},
+		"sample rate": {Stream: "test", SampleRate: 2},
+		"sample":      {Stream: "test", SampleRates: map[string]float64{"cool": -1}},
+		"parallelism": {Stream: "test", Parallelism: -1},
+		"queue":       {Stream: "test", MaxQueueEvents: -1},
+		"key":         {Stream: "test", EncryptionKey: make([]byte, 10)},
+	}
+
+	for name, config := range configs {
+		a := analytics.NewFromConfig(config)
+		if a.Err() == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		if err := a.Track("cool", nil); err != analytics.ErrNotInitialized {
+			t.Fatalf("%s: expected ErrNotInitialized, got %v", name, err)
+		}
+	}
+
+	if err := analytics.New("").Err(); err == nil || !strings.Contains(err.Error(), "missing stream name") {
+		t.Fatalf("expected a missing stream, got %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.New("test",
+		analytics.WithMemory(),
+		analytics.WithSink(s),
+		analytics.WithFlushOnClose(time.Second),
+		analytics.WithSampleRate(1),
+	)
+
+	if err := a.Track("cool", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 1 {
+		t.Fatalf("expected the event to be flushed on close, got %d", len(s.events))
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	home(t)
+	broken := analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		EncryptionKey: []byte("short"),
+	})
+
+	if broken.Lifecycle() != analytics.LifecycleUninitialized || broken.Err() == nil {
+		t.Fatalf("expected an uninitialized client, got %s", broken.Lifecycle())
+	}
+
+	if err := broken.Track("one", nil); err != analytics.ErrNotInitialized {
+		t.Fatalf("expected ErrNotInitialized, got %v", err)
+	}
+
+	if err := broken.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := analytics.New("test")
+	if a.Lifecycle() != analytics.LifecycleOpen {
+		t.Fatalf("expected an open client, got %s", a.Lifecycle())
+	}
+
+	a.Disable()
+	if a.Lifecycle() != analytics.LifecycleDisabled {
+		t.Fatalf("expected a disabled client, got %s", a.Lifecycle())
+	}
+
+	// opting out isn't an error
+	if err := a.Track("one", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Close()
+	if a.Lifecycle() != analytics.LifecycleClosed {
+		t.Fatalf("expected a closed client, got %s", a.Lifecycle())
+	}
+}
+
+// offlineSink waits until the context is done, like a send that
+// times out.
+type offlineSink struct{}
+
+func (offlineSink) Send(ctx context.Context, events []*analytics.Event) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFlushOnClose(t *testing.T) {
+	home(t)
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		Sink:         s,
+		FlushOnClose: true,
+	})
+	a.Track("cool", nil)
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.events) != 1 {
+		t.Fatalf("expected the event to be flushed on close, got %d", len(s.events))
+	}
+
+	// the flush is bounded, keeping the events queued
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:       "test",
+		Sink:         offlineSink{},
+		FlushOnClose: true,
+		FlushTimeout: 50 * time.Millisecond,
+	})
+	a.Track("cool", nil)
+
+	start := time.Now()
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected close to give up on the flush, took %s", elapsed)
+	}
+
+	a = analytics.New("test")
+	defer a.Close()
+	if n, _ := a.Size(); n != 1 {
+		t.Fatalf("expected the event to stay queued, got %d", n)
+	}
+}
+
+type blockingSink struct {
+	mu      sync.Mutex
+	calls   int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) Send(ctx context.Context, events []*analytics.Event) error {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+
+	close(s.started)
+	<-s.release
+	return nil
+}
+
+func TestFlushAsync(t *testing.T) {
+	home(t)
+	s := &blockingSink{started: make(chan struct{}), release: make(chan struct{})}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+	a.Track("one", nil)
+
+	errc := a.FlushAsync()
+	<-s.started
+
+	// tracking carries on while the flush is sending
+	if err := a.Track("two", nil); err != nil {
+		t.Fatal(err)
+	}
+	close(s.release)
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-errc; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+
+	if n, _ := a.Size(); n != 1 {
+		t.Fatalf("expected the new event to stay queued, got %d", n)
+	}
+
+	a.Sink = &sink{err: errors.New("offline")}
+	if err := <-a.FlushAsync(); err == nil {
+		t.Fatal("expected the flush error")
+	}
+}
+
+func TestSingleFlightFlush(t *testing.T) {
+	home(t)
+	s := &blockingSink{started: make(chan struct{}), release: make(chan struct{})}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+	a.Track("cool", nil)
+
+	first := a.FlushAsync()
+	<-s.started
+	second := a.FlushAsync()
+
+	// give the second flush a chance to start
+	time.Sleep(10 * time.Millisecond)
+	close(s.release)
+
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+
+	if s.calls != 1 {
+		t.Fatalf("expected the events to be sent once, got %d", s.calls)
+	}
+}
+
+type concurrentSink struct {
+	mu      sync.Mutex
+	events  int
+	active  int
+	maximum int
+}
+
+func (s *concurrentSink) Send(ctx context.Context, events []*analytics.Event) error {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maximum {
+		s.maximum = s.active
+	}
+	s.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	s.mu.Lock()
+	s.active--
+	s.events += len(events)
+	s.mu.Unlock()
+	return nil
+}
+
+func TestParallelism(t *testing.T) {
+	home(t)
+	s := &concurrentSink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Sink:        s,
+		Parallelism: 3,
+	})
+
+	for i := 0; i < 1500; i++ {
+		a.Track("cool", nil)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.events != 1500 {
+		t.Fatalf("expected 1500 events, got %d", s.events)
+	}
+
+	if s.maximum < 2 || s.maximum > 3 {
+		t.Fatalf("expected up to 3 concurrent batches, got %d", s.maximum)
+	}
+}
+
+func TestUpgrades(t *testing.T) {
+	home(t)
+	old := analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		SchemaVersion: 1,
+	})
+	old.Track("signup", analytics.Body{"plan_name": "pro"})
+	old.Track("login", nil)
+	old.Close()
+
+	s := &sink{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:        "test",
+		Sink:          s,
+		SchemaVersion: 2,
+		Upgrades: []analytics.Upgrade{{
+			Event: "signup",
+			From:  1,
+			Upgrade: func(e *analytics.Event) error {
+				e.Body["plan"] = e.Body["plan_name"]
+				delete(e.Body, "plan_name")
+				return nil
+			},
+		}},
+	})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(s.events))
+	}
+
+	signup := s.events[0].Body
+	if signup["plan"] != "pro" || signup["plan_name"] != nil || signup["schema_version"] != 2 {
+		t.Fatalf("expected the event to be upgraded, got %v", signup)
+	}
+
+	if s.events[1].Body["schema_version"] != 2 {
+		t.Fatalf("expected the version to be bumped, got %v", s.events[1].Body)
+	}
+}
+
+func TestMarshaler(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     c,
+		RawRecords: true,
+		Marshaler: analytics.MarshalerFunc(func(e *analytics.Event) ([]byte, error) {
+			return []byte(e.Event), nil
+		}),
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 || string(c.data[0]) != "cool" {
+		t.Fatalf("expected the custom record, got %q", c.data)
+	}
+}
+
+type registry struct {
+	glueiface.GlueAPI
+	calls      int
+	ctx        aws.Context
+	definition string
+}
+
+func (r *registry) GetSchemaVersionWithContext(ctx aws.Context, input *glue.GetSchemaVersionInput, opts ...request.Option) (*glue.GetSchemaVersionOutput, error) {
+	r.calls++
+	r.ctx = ctx
+	definition := r.definition
+	if definition == "" {
+		definition = `{"type":"object","required":["event","body"],"properties":{"body":{"type":"object","required":["plan"],"properties":{"plan":{"enum":["free","pro"]}}}}}`
+	}
+	return &glue.GetSchemaVersionOutput{
+		DataFormat:       aws.String(glue.DataFormatJson),
+		SchemaVersionId:  aws.String("b7b4a7f0-9c1e-4b9e-8f5e-2d5c0d2c6a11"),
+		SchemaDefinition: aws.String(definition),
+	}, nil
+}
+
+func TestGlueSchema(t *testing.T) {
+	home(t)
+	c := &client{}
+	r := &registry{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     c,
+		RawRecords: true,
+		Marshaler: &analytics.GlueSchema{
+			Client:   r,
+			Registry: "analytics",
+			Schema:   "events",
+		},
+	})
+	a.Track("signup", analytics.Body{"plan": "pro"})
+	a.Track("signup", analytics.Body{"plan": "gold"})
+	a.Track("signup", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 || r.calls != 1 {
+		t.Fatalf("expected 1 valid record from 1 lookup, got %d from %d", len(c.data), r.calls)
+	}
+
+	record := c.data[0]
+	if record[0] != 3 || record[1] != 0 || record[2] != 0xb7 || record[18] != '{' {
+		t.Fatalf("expected the registry's header, got %q", record)
+	}
+
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected the invalid events to be dropped, got %d", n)
+	}
+
+	// the schema's fetched with the flush's context
+	type key struct{}
+	c = &client{}
+	r = &registry{definition: `{"properties":{"body":{"properties":{"plan":{"enum":[1]}}}}}`}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     c,
+		RawRecords: true,
+		Marshaler:  &analytics.GlueSchema{Client: r},
+	})
+	a.Track("signup", analytics.Body{"plan": 1})
+	a.Track("signup", analytics.Body{"plan": "1"})
+
+	if err := a.FlushContext(context.WithValue(context.Background(), key{}, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.ctx == nil || r.ctx.Value(key{}) != true {
+		t.Fatal("expected the flush's context")
+	}
+
+	// enum values are compared with their types
+	if len(c.data) != 1 || !strings.Contains(string(c.data[0]), `"plan":1`) {
+		t.Fatalf("expected only the numeric plan, got %q", c.data)
+	}
+
+	// keywords that don't change the structure are ignored
+	c = &client{}
+	r = &registry{definition: `{"properties":{"body":{"properties":{"plan":{"type":"string","pattern":"^p","format":"uri","minLength":10,"description":"plan"}}}}}`}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     c,
+		RawRecords: true,
+		Marshaler:  &analytics.GlueSchema{Client: r},
+	})
+	a.Track("signup", analytics.Body{"plan": "free"})
+
+	if err := a.Flush(); err != nil || len(c.data) != 1 {
+		t.Fatalf("expected the event to be sent, got %v", err)
+	}
+
+	// schemas that can't be fully checked are rejected
+	r = &registry{definition: `{"properties":{"body":{"properties":{"plan":{"oneOf":[{"type":"string"},{"type":"number"}]}}}}}`}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     &client{},
+		RawRecords: true,
+		Marshaler:  &analytics.GlueSchema{Client: r},
+	})
+	a.Track("signup", analytics.Body{"plan": "free"})
+
+	if err := a.Flush(); err == nil || !strings.Contains(err.Error(), `unsupported schema keyword "oneOf"`) {
+		t.Fatalf("expected an unsupported keyword error, got %v", err)
+	}
+
+	if n, _ := a.Size(); n != 1 {
+		t.Fatalf("expected the event to stay queued, got %d", n)
+	}
+
+	if err := a.Erase(); err != nil {
+		t.Fatal(err)
+	}
+
+	// extra fields are checked against additionalProperties
+	c = &client{}
+	r = &registry{definition: `{"properties":{"body":{"properties":{"plan":{}},"additionalProperties":{"type":"string"}}}}`}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     c,
+		RawRecords: true,
+		Marshaler:  &analytics.GlueSchema{Client: r},
+	})
+	a.Track("signup", analytics.Body{"plan": "pro"})
+	a.Track("signup", analytics.Body{"plan": "pro", "seats": 5})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 {
+		t.Fatalf("expected the event with a numeric extra field to be dropped, got %d records", len(c.data))
+	}
+}
+
+func TestPartition(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:    "test",
+		Client:    c,
+		Partition: analytics.PartitionByEventDate,
+	})
+	a.TrackAt(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "signup", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 || !strings.Contains(string(c.data[0]), `"partition_keys":{"date":"2020-01-02","event":"signup"}`) {
+		t.Fatalf("expected the partition keys, got %q", c.data)
+	}
+
+	if !strings.Contains(string(c.data[0]), `"event":"signup"`) {
+		t.Fatalf("expected the event's fields, got %q", c.data)
+	}
+
+	// the keys are added to other JSON marshalers' records too
+	c = &client{}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:    "test",
+		Client:    c,
+		Partition: analytics.PartitionByEventDate,
+		Marshaler: &analytics.CloudEvents{Source: "myapp"},
+	})
+	a.TrackAt(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "signup", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(c.data[len(c.data)-1], &record); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := record["partition_keys"].(map[string]interface{})
+	if record["specversion"] != "1.0" || keys["date"] != "2020-01-02" {
+		t.Fatalf("expected a partitioned cloud event, got %s", c.data[len(c.data)-1])
+	}
+
+	// binary records can't be partitioned
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:    "test",
+		Partition: analytics.PartitionByEventDate,
+		Marshaler: &analytics.GlueSchema{},
+	})
+	if a.Err() == nil {
+		t.Fatal("expected partitioning Glue records to be rejected")
+	}
+}
+
+func TestCloudEvents(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:    "test",
+		Client:    c,
+		Marshaler: &analytics.CloudEvents{Source: "myapp"},
+	})
+	a.TrackAt(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "signup", analytics.Body{"plan": "pro"})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(c.data[0], &event); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := event["data"].(map[string]interface{})
+	if event["specversion"] != "1.0" || event["source"] != "myapp" || event["type"] != "signup" || event["time"] != "2020-01-02T03:04:05Z" || event["id"] == "" || data["plan"] != "pro" {
+		t.Fatalf("unexpected cloud event %s", c.data[0])
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:    "test",
+		Client:    c,
+		Marshaler: &analytics.Flatten{Separator: "."},
+	})
+	a.Track("signup", analytics.Body{
+		"plan": analytics.Body{"name": "pro", "limits": map[string]interface{}{"seats": 5}},
+		"tags": []string{"a", "b"},
+	})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var columns map[string]interface{}
+	if err := json.Unmarshal(c.data[0], &columns); err != nil {
+		t.Fatal(err)
+	}
+
+	if columns["plan.name"] != "pro" || columns["plan.limits.seats"] != float64(5) || columns["event"] != "signup" || columns["plan"] != nil {
+		t.Fatalf("expected flat columns, got %s", c.data[0])
+	}
+
+	if tags, ok := columns["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Fatalf("expected arrays to be kept, got %s", c.data[0])
+	}
+}
+
+func TestRecordNewlines(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Client: c,
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 || !bytes.HasSuffix(c.data[0], []byte("}\n")) {
+		t.Fatalf("expected a newline-delimited record, got %q", c.data)
+	}
+
+	home(t)
+	c = &client{}
+	a = analytics.NewFromConfig(&analytics.Config{
+		Stream:     "test",
+		Client:     c,
+		RawRecords: true,
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 || !bytes.HasSuffix(c.data[0], []byte("}")) {
+		t.Fatalf("expected a raw record, got %q", c.data)
+	}
+}
+
+func TestGzipRecords(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Client:      c,
+		GzipRecords: true,
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.data) != 1 || !bytes.HasPrefix(c.data[0], []byte{0x1f, 0x8b}) {
+		t.Fatalf("expected a gzipped record, got %q", c.data)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(c.data[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), `"event":"cool"`) {
+		t.Fatalf("unexpected record %s", b)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	home(t)
+	c := &client{failures: 1}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:    "test",
+		Client:    c,
+		Aggregate: true,
+	})
+
+	for i := 0; i < 3; i++ {
+		a.Track("cool", nil)
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed record is retried with all of its events
+	if c.records != 2 {
+		t.Fatalf("expected 2 records, got %d", c.records)
+	}
+
+	if n := bytes.Count(c.data[1], []byte("\n")); n != 3 {
+		t.Fatalf("expected 3 events in the record, got %d", n)
+	}
+}
+
+type health struct {
+	mu                                               sync.Mutex
+	tracked, dropped, flushed, failed, retried, sent int
+	flushes                                          int
+}
+
+func (m *health) add(n *int, v int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*n += v
+}
+
+func (m *health) Tracked(n int)                 { m.add(&m.tracked, n) }
+func (m *health) Dropped(n int)                 { m.add(&m.dropped, n) }
+func (m *health) Flushed(n int)                 { m.add(&m.flushed, n) }
+func (m *health) Failed(n int)                  { m.add(&m.failed, n) }
+func (m *health) Retried(n int)                 { m.add(&m.retried, n) }
+func (m *health) Sent(n int)                    { m.add(&m.sent, n) }
+func (m *health) FlushDuration(d time.Duration) { m.add(&m.flushes, 1) }
+
+func TestHealthMetrics(t *testing.T) {
+	home(t)
+	m := &health{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Client:  &client{failures: 1},
+		Metrics: m,
+		Filters: []analytics.Filter{
+			func(event *analytics.Event) bool {
+				return event.Event != "secret"
+			},
+		},
+	})
+
+	a.Track("one", nil)
+	a.Track("two", nil)
+	a.Track("secret", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.tracked != 2 || m.dropped != 1 || m.flushed != 2 || m.failed != 0 {
+		t.Fatalf("unexpected counts %+v", m)
+	}
+
+	if m.retried != 1 || m.sent == 0 || m.flushes != 1 {
+		t.Fatalf("unexpected counts %+v", m)
+	}
+}
+
+type tracer struct {
+	spans []string
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, analytics.Span) {
+	t.spans = append(t.spans, name)
+	return ctx, span{}
+}
+
+type span struct{}
+
+func (span) Set(string, interface{}) {}
+func (span) End(error)               {}
+
+func TestTracer(t *testing.T) {
+	home(t)
+	tr := &tracer{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Client: &client{failures: 1},
+		Tracer: tr,
+	})
+	a.Track("cool", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retry is traced too
+	expect := "analytics.flush analytics.batch firehose.PutRecordBatch firehose.PutRecordBatch"
+	if spans := strings.Join(tr.spans, " "); spans != expect {
+		t.Fatalf("unexpected spans %s", spans)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := home(t)
+	s := &sink{err: errors.New("boom")}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   s,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+	a.Flush()
+	a.Flush()
+
+	stats, err := a.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Events != 2 || stats.Bytes == 0 || !stats.Enabled {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if stats.Failures != 2 || stats.LastError == nil {
+		t.Fatalf("expected 2 failures, got %+v", stats)
+	}
+
+	if stats.StateDir != dir+"/state/test" {
+		t.Fatalf("unexpected state dir %s", stats.StateDir)
+	}
+
+	s.err = nil
+	a.Flush()
+
+	if stats, _ = a.Stats(); stats.Failures != 0 || stats.Events != 0 || stats.LastFlush.IsZero() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// safe to read while flushing
+	a.Track("three", nil)
+	errc := a.FlushAsync()
+	a.Stats()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	home(t)
+	m := &health{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Client:  &client{},
+		DryRun:  true,
+		Metrics: m,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.flushed != 2 || m.sent != 0 {
+		t.Fatalf("unexpected counts %+v", m)
+	}
+
+	if n, _ := a.Size(); n != 2 {
+		t.Fatalf("expected the events to stay queued, got %d", n)
+	}
+}
+
+func TestDump(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	a.Track("signup", analytics.Body{"plan": "pro"})
+
+	var buf bytes.Buffer
+	if err := a.Dump(&buf, "table"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "SEQ") {
+		t.Fatalf("unexpected table %s", buf.String())
+	}
+
+	if !strings.Contains(lines[1], "signup") || !strings.Contains(lines[1], `"plan":"pro"`) {
+		t.Fatalf("unexpected row %s", lines[1])
+	}
+
+	buf.Reset()
+	if err := a.Dump(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `  "event": "signup"`) {
+		t.Fatalf("unexpected json %s", buf.String())
+	}
+
+	if err := a.Dump(&buf, "xml"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestPing(t *testing.T) {
+	home(t)
+	c := &client{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Client: c,
+	})
+
+	if err := a.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Fatalf("expected a missing stream, got %v", err)
+	}
+
+	c.status = firehose.DeliveryStreamStatusActive
+	if err := a.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.calls != 0 {
+		t.Fatal("expected no events to be sent")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dir := home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Archive: 1,
+	})
+	a.Track("one", nil)
+	a.Track("two", nil)
+
+	if err := a.Purge(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := a.Size(); err != nil || n != 0 {
+		t.Fatalf("expected no events, got %d: %v", n, err)
+	}
+
+	entries, err := os.ReadDir(dir + "/state/test/archive")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the events to be archived: %v", err)
+	}
+
+	// tracking carries on after a purge
+	a.Track("three", nil)
+	if n, _ := a.Size(); n != 1 {
+		t.Fatalf("expected 1 event, got %d", n)
+	}
+}
+
+func TestErase(t *testing.T) {
+	dir := home(t)
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Archive: 1,
+	})
+	a.Identify("user-1", analytics.Body{"plan": "pro"})
+	a.Track("one", nil)
+
+	before, err := os.ReadFile(dir + "/config/test/id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Erase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected no events, got %d", n)
+	}
+
+	if _, err := os.Stat(dir + "/config/test/traits"); !os.IsNotExist(err) {
+		t.Fatalf("expected the traits to be removed: %v", err)
+	}
+
+	if _, err := os.Stat(dir + "/state/test/archive"); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing archived: %v", err)
+	}
+
+	a.Track("two", nil)
+	events, err := a.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Body["user_id"] != nil || events[0].Seq != 1 {
+		t.Fatalf("expected a fresh start, got %v", events)
+	}
+
+	after, err := os.ReadFile(dir + "/config/test/id")
+	if err != nil || string(after) == string(before) {
+		t.Fatalf("expected a new id, got %s: %v", after, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	home(t)
+	a := analytics.New("test")
+	a.Track("signup", analytics.Body{"plan": "pro"})
+	a.Disable()
+
+	var buf bytes.Buffer
+	if err := a.Export(&buf, analytics.FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[1][3] != "signup" || !strings.Contains(rows[1][4], `"plan":"pro"`) {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	buf.Reset()
+	if err := a.Export(&buf, analytics.FormatNDJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("expected 1 line, got %d", n)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	home(t)
+	c := &client{failures: 10}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Client:  c,
+		Backoff: analytics.Backoff{MaxAttempts: 1},
+	})
+
+	for i := 0; i < 3; i++ {
+		a.Track("cool", nil)
+	}
+
+	// the first record fails
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// only the failed record is sent again
+	c.failures = 0
+	c.records = 0
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.records != 1 {
+		t.Fatalf("expected 1 record to be resent, got %d", c.records)
+	}
+
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected no events, got %d", n)
+	}
+}
+
+func TestCheckpointWithoutIDs(t *testing.T) {
+	home(t)
+
+	// events queued before they had IDs
+	store := &analytics.MemoryStore{}
+	for i := 0; i < 3; i++ {
+		store.Append(&analytics.Event{Event: "legacy", Timestamp: time.Now().Format(time.RFC3339)})
+	}
+
+	c := &client{failures: 10}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:      "test",
+		Client:      c,
+		Store:       store,
+		Backoff:     analytics.Backoff{MaxAttempts: 1},
+		MaxAttempts: 2,
+	})
+	defer a.Close()
+
+	// the first event fails, and counts its own attempts
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if dead, _ := a.DeadLetter(); len(dead) != 0 {
+		t.Fatalf("expected no dead letters yet, got %d", len(dead))
+	}
+
+	// only the failed event is sent again
+	c.records = 0
+	if err := a.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if c.records != 1 {
+		t.Fatalf("expected 1 record to be resent, got %d", c.records)
+	}
+
+	if dead, _ := a.DeadLetter(); len(dead) != 1 {
+		t.Fatalf("expected the failed event to be dead-lettered, got %d", len(dead))
+	}
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.Size(); n != 0 {
+		t.Fatalf("expected no events, got %d", n)
+	}
+}
+
+func benchmarkTrack(b *testing.B, config *analytics.Config) {
+	dir := b.TempDir()
+	b.Setenv("XDG_CONFIG_HOME", dir+"/config")
+	b.Setenv("XDG_STATE_HOME", dir+"/state")
+
+	config.Stream = "test"
+	a := analytics.NewFromConfig(config)
+	defer a.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		a.Track("cool", analytics.Body{"n": i})
+	}
+}
+
+func BenchmarkTrack(b *testing.B) {
+	benchmarkTrack(b, &analytics.Config{})
+}
+
+func BenchmarkTrackBuffered(b *testing.B) {
+	benchmarkTrack(b, &analytics.Config{WriteBuffer: 64 * 1024})
+}
+
+func BenchmarkTrackEncrypted(b *testing.B) {
+	benchmarkTrack(b, &analytics.Config{EncryptionKey: make([]byte, 32)})
+}
+
+func BenchmarkTrackMemory(b *testing.B) {
+	benchmarkTrack(b, &analytics.Config{Memory: true})
+}
@@ -0,0 +1,60 @@
+package analytics
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Flatten serializes events as flat JSON objects for columnar targets like
+// Redshift's COPY, which can't load nested JSON. Nested body keys become
+// top-level columns joined by the Separator, alongside id, seq, ts and event,
+// which take precedence over body keys of the same name. Set it as the
+// Config's Marshaler.
+type Flatten struct {
+	Separator string // Separator between nested keys. Defaults to "_"
+}
+
+// Marshal the event as a flat object.
+func (f *Flatten) Marshal(event *Event) ([]byte, error) {
+	sep := f.Separator
+	if sep == "" {
+		sep = "_"
+	}
+
+	columns := map[string]interface{}{}
+	flatten(columns, "", sep, event.Body)
+
+	columns["id"] = event.ID
+	columns["ts"] = event.Timestamp
+	columns["event"] = event.Event
+	if event.Seq != 0 {
+		columns["seq"] = event.Seq
+	}
+
+	data, err := json.Marshal(columns)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	return data, nil
+}
+
+// flatten the nested maps in `body` into `columns`, joining keys with `sep`.
+func flatten(columns map[string]interface{}, prefix, sep string, body map[string]interface{}) {
+	for k, v := range body {
+		key := k
+		if prefix != "" {
+			key = prefix + sep + k
+		}
+
+		switch nested := v.(type) {
+		case map[string]interface{}:
+			flatten(columns, key, sep, nested)
+		case Body:
+			flatten(columns, key, sep, nested)
+		default:
+			columns[key] = v
+		}
+	}
+}
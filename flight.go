@@ -0,0 +1,39 @@
+package analytics
+
+import "context"
+
+// flight is a flush in progress, which concurrent flushes wait on
+// rather than reading and sending the same events again.
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// singleFlight runs fn unless a flush is already in flight, in which
+// case it waits for that flush and returns its result.
+func (a *Analytics) singleFlight(ctx context.Context, fn func() error) error {
+	a.flightMu.Lock()
+	if f := a.inflight; f != nil {
+		a.flightMu.Unlock()
+
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f := &flight{done: make(chan struct{})}
+	a.inflight = f
+	a.flightMu.Unlock()
+
+	f.err = fn()
+
+	a.flightMu.Lock()
+	a.inflight = nil
+	a.flightMu.Unlock()
+
+	close(f.done)
+	return f.err
+}
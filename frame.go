@@ -0,0 +1,155 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// crc32c checksums each record.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// buffers are reused between appends, so tracking in a tight
+// loop doesn't allocate a buffer for every event.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooled is the largest buffer kept in the pool, so a single
+// huge event doesn't stay in memory.
+const maxPooled = 64 * 1024
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns the buffer to the pool.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooled {
+		buffers.Put(buf)
+	}
+}
+
+// encode the event to w as a line framed as `#<crc32c> <record>`, so a
+// torn write is detected rather than decoded. The record is encrypted and
+// base64 encoded if there's an encryption key. Each append writes its
+// lines in one call while holding the lock, so records never interleave.
+func (s *fileStore) encode(w *bytes.Buffer, event *Event) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := json.NewEncoder(buf).Encode(event); err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+	record := bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
+
+	if s.aead != nil {
+		sealed, err := seal(s.aead, record)
+		if err != nil {
+			return err
+		}
+
+		record = make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+		base64.StdEncoding.Encode(record, sealed)
+	}
+
+	var sum [8]byte
+	hex.Encode(sum[:], checksum(record))
+
+	w.WriteByte('#')
+	w.Write(sum[:])
+	w.WriteByte(' ')
+	w.Write(record)
+	w.WriteByte('\n')
+	return nil
+}
+
+// decode a line written by encode. Unframed and unencrypted lines from
+// older versions are read as-is, so they're still sent.
+func (s *fileStore) decode(line []byte) (*Event, error) {
+	line, err := unframe(bytes.TrimSpace(line))
+	if err != nil {
+		return nil, err
+	}
+
+	if line[0] != '{' {
+		if s.aead == nil {
+			return nil, errors.New("event is encrypted, but there's no encryption key")
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return nil, err
+		}
+
+		line, err = unseal(s.aead, sealed)
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypting")
+		}
+	}
+
+	var e Event
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// unframe returns the record in the line, verifying its checksum.
+// Unframed lines are returned as-is.
+func unframe(line []byte) ([]byte, error) {
+	if len(line) == 0 || line[0] != '#' {
+		return line, nil
+	}
+
+	if len(line) < 11 || line[9] != ' ' {
+		return nil, errors.New("invalid frame")
+	}
+
+	sum, err := hex.DecodeString(string(line[1:9]))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid checksum")
+	}
+
+	record := line[10:]
+	if !bytes.Equal(sum, checksum(record)) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return record, nil
+}
+
+// intact returns true if the line holds an event. Framed lines only
+// need their checksum verified, rather than being decoded.
+func (s *fileStore) intact(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return false
+	}
+
+	if line[0] != '#' {
+		return s.valid(line)
+	}
+
+	_, err := unframe(line)
+	return err == nil
+}
+
+// checksum returns the big-endian crc32c of the record.
+func checksum(record []byte) []byte {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(record, crc32c))
+	return sum[:]
+}
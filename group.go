@@ -0,0 +1,71 @@
+package analytics
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// group the user belongs to, stored in ~/<dir>/group.
+type group struct {
+	GroupID string `json:"group_id"`
+	Traits  Body   `json:"traits,omitempty"`
+}
+
+// init ~/<dir>/group.
+func (a *Analytics) initGroup() {
+	b, err := a.readSecret("group")
+	if err != nil {
+		return
+	}
+
+	var g group
+	if err := json.Unmarshal(b, &g); err != nil {
+		a.Log.WithError(err).Debug("error reading group")
+		return
+	}
+
+	a.group = &g
+}
+
+// Group associates the user with the organization `groupID` and optional
+// `traits`. The group is saved to ~/<dir>/group and its ID is attached to
+// every subsequent event.
+func (a *Analytics) Group(groupID string, traits Body) error {
+	if !a.active() {
+		return nil
+	}
+
+	g := &group{
+		GroupID: groupID,
+		Traits:  traits,
+	}
+
+	b, err := json.Marshal(g)
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	if err := a.writeSecret("group", b); err != nil {
+		return errors.Wrap(err, "saving group")
+	}
+
+	a.mu.Lock()
+	a.group = g
+	a.mu.Unlock()
+
+	return a.Track("group", Body{
+		"group_traits": traits,
+	})
+}
+
+// attach the group to the body.
+func (a *Analytics) attachGroup(body Body) {
+	if a.group == nil {
+		return
+	}
+
+	if body["group_id"] == nil {
+		body.Set("group_id", a.group.GroupID)
+	}
+}
@@ -0,0 +1,34 @@
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// hashIdentifiers replaces user_id and the Identifiers with their
+// salted SHA-256, so they stay distinct per user without leaving the
+// machine in the clear.
+func (a *Analytics) hashIdentifiers(body Body) {
+	if a.HashSalt == "" {
+		return
+	}
+
+	if v, ok := body["user_id"]; ok && v != nil {
+		body["user_id"] = hashValue(a.HashSalt, v)
+	}
+
+	for _, k := range a.Identifiers {
+		if v, ok := body[k]; ok && v != nil {
+			body[k] = hashValue(a.HashSalt, v)
+		}
+	}
+}
+
+// hashValue returns the hex HMAC-SHA256 of `v` keyed by `salt`.
+func hashValue(salt string, v interface{}) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	fmt.Fprint(mac, v)
+	return hex.EncodeToString(mac.Sum(nil))
+}
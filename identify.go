@@ -0,0 +1,155 @@
+package analytics
+
+import (
+	"encoding/json"
+	"os"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/pkg/errors"
+)
+
+// identity of a known user, stored in ~/<dir>/traits.
+type identity struct {
+	UserID string `json:"user_id"`
+	Traits Body   `json:"traits,omitempty"`
+}
+
+// init ~/<dir>/traits.
+func (a *Analytics) initTraits() {
+	b, err := a.readSecret("traits")
+	if err != nil {
+		return
+	}
+
+	var id identity
+	if err := json.Unmarshal(b, &id); err != nil {
+		a.Log.WithError(err).Debug("error reading traits")
+		return
+	}
+
+	a.identity = &id
+}
+
+// Identify the user as `userID` with optional `traits`. The user ID and
+// traits are saved to ~/<dir>/traits and attached to subsequent events,
+// along with the anonymous ID. Traits are merged with the ones previously
+// saved for the same user.
+func (a *Analytics) Identify(userID string, traits Body) error {
+	if !a.active() {
+		return nil
+	}
+
+	id := &identity{
+		UserID: userID,
+		Traits: Body{},
+	}
+
+	a.mu.Lock()
+	if a.identity != nil && a.identity.UserID == userID {
+		for k, v := range a.identity.Traits {
+			id.Traits.Set(k, v)
+		}
+	}
+	a.mu.Unlock()
+
+	for k, v := range traits {
+		id.Traits.Set(k, v)
+	}
+
+	b, err := json.Marshal(id)
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	if err := a.writeSecret("traits", b); err != nil {
+		return errors.Wrap(err, "saving traits")
+	}
+
+	a.mu.Lock()
+	a.identity = id
+	a.mu.Unlock()
+
+	return a.Track("identify", nil)
+}
+
+// attach the identity to the body.
+func (a *Analytics) attachIdentity(body Body) {
+	if a.identity == nil {
+		return
+	}
+
+	if body["anonymous_id"] == nil {
+		body.Set("anonymous_id", a.userID)
+	}
+
+	if body["user_id"] == nil {
+		body.Set("user_id", a.identity.UserID)
+	}
+
+	if body["traits"] == nil && len(a.identity.Traits) > 0 {
+		body.Set("traits", a.identity.Traits)
+	}
+}
+
+// Alias links `previousID` to `newID` by emitting an alias event, then
+// saves `newID` to ~/<dir>/id so subsequent events use it. The current
+// ID is used when `previousID` is empty.
+func (a *Analytics) Alias(previousID, newID string) error {
+	if !a.active() {
+		return nil
+	}
+
+	if previousID == "" {
+		a.mu.Lock()
+		previousID = a.userID
+		a.mu.Unlock()
+	}
+
+	err := a.Track("alias", Body{
+		"previous_id": previousID,
+		"user_id":     newID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := a.writeFile("id", []byte(newID)); err != nil {
+		return errors.Wrap(err, "saving id")
+	}
+
+	a.mu.Lock()
+	a.userID = newID
+	a.mu.Unlock()
+	return nil
+}
+
+// ResetID resets the user's telemetry identity, generating a new
+// anonymous ID saved to ~/<dir>/id and forgetting the identified user,
+// their traits and group, so later events can't be linked to them.
+func (a *Analytics) ResetID() (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", errors.Wrap(err, "generating id")
+	}
+
+	if err := a.mkdir(); err != nil {
+		return "", errors.Wrap(err, "creating dir")
+	}
+
+	if err := a.writeFile("id", []byte(id)); err != nil {
+		return "", errors.Wrap(err, "saving id")
+	}
+
+	for _, name := range []string{"traits", "group"} {
+		if err := a.removeFile(name); err != nil && !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "removing %s", name)
+		}
+	}
+
+	a.mu.Lock()
+	a.userID = id
+	a.identity = nil
+	a.group = nil
+	a.mu.Unlock()
+	return id, nil
+}
@@ -0,0 +1,33 @@
+package analytics
+
+import "time"
+
+// Metrics receives counters for the library's own health, so it can be
+// piped into the application's monitoring. Implementations must be safe
+// for concurrent use.
+type Metrics interface {
+	Tracked(n int)                 // Tracked events written to the queue
+	Dropped(n int)                 // Dropped events, by filters, sampling, the oversize policy, eviction or expiry
+	Flushed(n int)                 // Flushed events delivered to the sink
+	Failed(n int)                  // Failed events the sink couldn't deliver
+	Retried(n int)                 // Retried records Firehose rejected
+	Sent(bytes int)                // Sent bytes of the records delivered to Firehose
+	FlushDuration(d time.Duration) // FlushDuration of each flush
+}
+
+// flushResulter is implemented by Metrics that count flushes by
+// whether they succeeded.
+type flushResulter interface {
+	FlushResult(err error)
+}
+
+// nopMetrics discards the metrics.
+type nopMetrics struct{}
+
+func (nopMetrics) Tracked(int)                 {}
+func (nopMetrics) Dropped(int)                 {}
+func (nopMetrics) Flushed(int)                 {}
+func (nopMetrics) Failed(int)                  {}
+func (nopMetrics) Retried(int)                 {}
+func (nopMetrics) Sent(int)                    {}
+func (nopMetrics) FlushDuration(time.Duration) {}
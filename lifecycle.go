@@ -0,0 +1,72 @@
+package analytics
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Lifecycle of the client.
+type Lifecycle int
+
+// Lifecycle states
+const (
+	LifecycleUninitialized Lifecycle = iota // Setting up failed, see Err
+	LifecycleOpen                           // Tracking events
+	LifecycleDisabled                       // The user opted out
+	LifecycleClosed                         // Closed or shut down
+)
+
+// String returns the state's name.
+func (l Lifecycle) String() string {
+	switch l {
+	case LifecycleUninitialized:
+		return "uninitialized"
+	case LifecycleOpen:
+		return "open"
+	case LifecycleDisabled:
+		return "disabled"
+	case LifecycleClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("Lifecycle(%d)", int(l))
+	}
+}
+
+// Errors returned when tracking with a client that can't track. Tracking
+// while disabled isn't an error, since the user chose to opt out.
+var (
+	ErrNotInitialized = errors.New("analytics: not initialized")
+	ErrClosed         = errors.New("analytics: closed")
+)
+
+// Lifecycle returns the client's state.
+func (a *Analytics) Lifecycle() Lifecycle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lifecycle
+}
+
+// Err returns why the client couldn't be set up, nil if it was.
+func (a *Analytics) Err() error {
+	return a.initErr
+}
+
+// fail setting up, leaving the client uninitialized.
+func (a *Analytics) fail(err error, msg string) {
+	a.Log.WithError(err).Error(msg)
+	a.initErr = errors.Wrap(err, msg)
+}
+
+// usable returns an error if the client is broken or closed,
+// while holding the lock.
+func (a *Analytics) usable() error {
+	switch a.lifecycle {
+	case LifecycleUninitialized:
+		return ErrNotInitialized
+	case LifecycleClosed:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
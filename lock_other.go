@@ -0,0 +1,21 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package analytics
+
+import "os"
+
+// lockFile is a no-op on platforms without file locking.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// tryLockFile is a no-op on platforms without file locking.
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+// unlockFile is a no-op on platforms without file locking.
+func unlockFile(f *os.File) error {
+	return nil
+}
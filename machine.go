@@ -0,0 +1,55 @@
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+)
+
+// machineID hashes the hostname and first hardware address with `salt`,
+// so the same machine gets the same ID across installs without the
+// hostname or address leaving it.
+func machineID(salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+
+	if host, err := os.Hostname(); err == nil {
+		mac.Write([]byte(host))
+	}
+
+	if addr := hardwareAddr(); addr != nil {
+		mac.Write(addr)
+	}
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hardwareAddr returns the address of the first non-loopback interface.
+func hardwareAddr() net.HardwareAddr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+
+		return iface.HardwareAddr
+	}
+
+	return nil
+}
+
+// attach the machine ID to the body.
+func (a *Analytics) attachMachine(body Body) {
+	if a.machine == "" {
+		return
+	}
+
+	if body["machine_id"] == nil {
+		body.Set("machine_id", a.machine)
+	}
+}
@@ -0,0 +1,79 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Marshaler serializes events into Firehose records, e.g. as Avro,
+// MessagePack or protobuf. Binary formats will usually want RawRecords
+// rather than newline-delimited records.
+type Marshaler interface {
+	Marshal(event *Event) ([]byte, error)
+}
+
+// MarshalerFunc adapts a function to a Marshaler.
+type MarshalerFunc func(event *Event) ([]byte, error)
+
+// Marshal the event.
+func (fn MarshalerFunc) Marshal(event *Event) ([]byte, error) {
+	return fn(event)
+}
+
+// JSONMarshaler serializes events as JSON, the default.
+type JSONMarshaler struct{}
+
+// Marshal the event as JSON.
+func (JSONMarshaler) Marshal(event *Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// validator is implemented by marshalers that can reject events before
+// they're sent, returning an invalidError for events that don't fit.
+type validator interface {
+	Validate(ctx context.Context, event *Event) error
+}
+
+// contextMarshaler is implemented by marshalers that may need the
+// network, so sending can cancel them.
+type contextMarshaler interface {
+	MarshalContext(ctx context.Context, event *Event) ([]byte, error)
+}
+
+// sizer is implemented by marshalers that can tell the size of an
+// event's record without marshaling it, e.g. before a schema's fetched.
+type sizer interface {
+	Size(event *Event) (int, error)
+}
+
+// invalidError is returned for events that don't fit the schema.
+type invalidError struct {
+	err error
+}
+
+func (e *invalidError) Error() string {
+	return "invalid event: " + e.err.Error()
+}
+
+// validate the events with the marshaler, dropping the invalid ones.
+func (a *Analytics) validate(ctx context.Context, events []*Event) ([]*Event, error) {
+	v, ok := a.Marshaler.(validator)
+	if !ok {
+		return events, nil
+	}
+
+	valid := events[:0:0]
+	for _, event := range events {
+		err := v.Validate(ctx, event)
+		if _, invalid := err.(*invalidError); invalid {
+			a.Log.WithError(err).WithField("event", event.Event).Debug("dropping invalid event")
+			a.Metrics.Dropped(1)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		valid = append(valid, event)
+	}
+
+	return valid, nil
+}
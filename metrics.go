@@ -0,0 +1,143 @@
+package analytics
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// metrics aggregated between flushes, stored in ~/<dir>/metrics.
+type metrics struct {
+	Counters map[string]int64   `json:"counters,omitempty"`
+	Gauges   map[string]float64 `json:"gauges,omitempty"`
+}
+
+func (m *metrics) empty() bool {
+	return len(m.Counters) == 0 && len(m.Gauges) == 0
+}
+
+// merge other into m, adding counters and replacing gauges.
+func (m *metrics) merge(other *metrics) {
+	for k, n := range other.Counters {
+		if m.Counters == nil {
+			m.Counters = map[string]int64{}
+		}
+		m.Counters[k] += n
+	}
+	for k, v := range other.Gauges {
+		if m.Gauges == nil {
+			m.Gauges = map[string]float64{}
+		}
+		m.Gauges[k] = v
+	}
+}
+
+// Count increments counter `name` by `n`. Counters are aggregated
+// and rolled up into a single "metrics" event on the next flush.
+func (a *Analytics) Count(name string, n int64) {
+	if !a.permits(ConsentFull) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metrics.merge(&metrics{Counters: map[string]int64{name: n}})
+}
+
+// Gauge sets gauge `name` to `v`. The last value set is rolled up
+// into a single "metrics" event on the next flush.
+func (a *Analytics) Gauge(name string, v float64) {
+	if !a.permits(ConsentFull) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metrics.merge(&metrics{Gauges: map[string]float64{name: v}})
+}
+
+// readMetrics reads the metrics saved in ~/<dir>/metrics.
+func (a *Analytics) readMetrics() (*metrics, error) {
+	m := &metrics{}
+
+	b, err := a.readFile("metrics")
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrap(err, "decoding")
+	}
+
+	return m, nil
+}
+
+// exclusive runs fn holding the store's lock, so processes sharing it
+// don't read or write the metrics in between.
+func (a *Analytics) exclusive(fn func() error) error {
+	if s, ok := a.store.(excluder); ok {
+		return s.exclusive(fn)
+	}
+	return fn()
+}
+
+// saveMetrics merges the metrics in memory into ~/<dir>/metrics.
+func (a *Analytics) saveMetrics() error {
+	return a.exclusive(a.mergeMetrics)
+}
+
+// mergeMetrics merges the metrics in memory into the saved ones.
+func (a *Analytics) mergeMetrics() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.metrics.empty() {
+		return nil
+	}
+
+	m, err := a.readMetrics()
+	if err != nil {
+		return errors.Wrap(err, "reading metrics")
+	}
+	m.merge(&a.metrics)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	if err := a.writeFile("metrics", b); err != nil {
+		return errors.Wrap(err, "saving metrics")
+	}
+
+	a.metrics = metrics{}
+	return nil
+}
+
+// rollup the aggregated metrics into a "metrics" event, tracked like
+// any other so the filters, sampling and middleware apply.
+func (a *Analytics) rollup() error {
+	return a.exclusive(func() error {
+		if err := a.mergeMetrics(); err != nil {
+			return err
+		}
+
+		m, err := a.readMetrics()
+		if err != nil {
+			return errors.Wrap(err, "reading metrics")
+		} else if m.empty() {
+			return nil
+		}
+
+		event := a.event("metrics", Body{
+			"counters": m.Counters,
+			"gauges":   m.Gauges,
+		})
+		if err := a.track(event, a.write); err != nil {
+			return err
+		}
+
+		return a.removeFile("metrics")
+	})
+}
@@ -0,0 +1,153 @@
+//go:build prometheus
+// +build prometheus
+
+package analytics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusCollector exposes the library's health to Prometheus. Pass it
+// as Config.Metrics to count the flushes, failures and retries, and call
+// Observe to export the queue depth and last flush age too. It's only
+// available when building with `-tags prometheus`.
+type PrometheusCollector struct {
+	analytics *Analytics
+
+	tracked  prometheus.Counter
+	dropped  prometheus.Counter
+	flushed  prometheus.Counter
+	failed   prometheus.Counter
+	retried  prometheus.Counter
+	sent     prometheus.Counter
+	flushes  *prometheus.CounterVec
+	duration prometheus.Histogram
+	queue    *prometheus.Desc
+	age      *prometheus.Desc
+}
+
+// NewPrometheusCollector creates a collector, prefixing the metric
+// names with `namespace`.
+func NewPrometheusCollector(namespace string) *PrometheusCollector {
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "analytics",
+			Name:      name,
+			Help:      help,
+		})
+	}
+
+	return &PrometheusCollector{
+		tracked: counter("events_tracked_total", "Events written to the queue."),
+		dropped: counter("events_dropped_total", "Events dropped before they were sent."),
+		flushed: counter("events_flushed_total", "Events delivered to the sink."),
+		failed:  counter("events_failed_total", "Events the sink couldn't deliver."),
+		retried: counter("records_retried_total", "Records retried after Firehose rejected them."),
+		sent:    counter("sent_bytes_total", "Bytes of the records delivered to Firehose."),
+		flushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "analytics",
+			Name:      "flushes_total",
+			Help:      "Flushes by result, success or failure.",
+		}, []string{"result"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "analytics",
+			Name:      "flush_duration_seconds",
+			Help:      "How long each flush took.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		queue: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "analytics", "queue_events"),
+			"Events queued to be sent.",
+			nil, nil,
+		),
+		age: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "analytics", "last_flush_age_seconds"),
+			"Seconds since the last flush that sent events.",
+			nil, nil,
+		),
+	}
+}
+
+// Observe exports the queue depth and last flush age of `a`.
+func (c *PrometheusCollector) Observe(a *Analytics) {
+	c.analytics = a
+}
+
+// Tracked implements Metrics.
+func (c *PrometheusCollector) Tracked(n int) { c.tracked.Add(float64(n)) }
+
+// Dropped implements Metrics.
+func (c *PrometheusCollector) Dropped(n int) { c.dropped.Add(float64(n)) }
+
+// Flushed implements Metrics.
+func (c *PrometheusCollector) Flushed(n int) { c.flushed.Add(float64(n)) }
+
+// Failed implements Metrics.
+func (c *PrometheusCollector) Failed(n int) { c.failed.Add(float64(n)) }
+
+// Retried implements Metrics.
+func (c *PrometheusCollector) Retried(n int) { c.retried.Add(float64(n)) }
+
+// Sent implements Metrics.
+func (c *PrometheusCollector) Sent(bytes int) { c.sent.Add(float64(bytes)) }
+
+// FlushDuration implements Metrics.
+func (c *PrometheusCollector) FlushDuration(d time.Duration) {
+	c.duration.Observe(d.Seconds())
+}
+
+// FlushResult counts the flush by its result.
+func (c *PrometheusCollector) FlushResult(err error) {
+	if err != nil {
+		c.flushes.WithLabelValues("failure").Inc()
+		return
+	}
+	c.flushes.WithLabelValues("success").Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (c *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.collectors() {
+		m.Describe(ch)
+	}
+	ch <- c.queue
+	ch <- c.age
+}
+
+// Collect implements prometheus.Collector.
+func (c *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.collectors() {
+		m.Collect(ch)
+	}
+
+	if c.analytics == nil {
+		return
+	}
+
+	if n, err := c.analytics.Size(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.queue, prometheus.GaugeValue, float64(n))
+	}
+
+	if last, err := c.analytics.LastFlush(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, time.Since(last).Seconds())
+	}
+}
+
+// collectors returns the metrics counted by the collector.
+func (c *PrometheusCollector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.tracked,
+		c.dropped,
+		c.flushed,
+		c.failed,
+		c.retried,
+		c.sent,
+		c.flushes,
+		c.duration,
+	}
+}
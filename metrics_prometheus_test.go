@@ -0,0 +1,67 @@
+//go:build prometheus
+// +build prometheus
+
+package analytics_test
+
+import (
+	"testing"
+
+	"github.com/matthewmueller/firehose-analytics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	home(t)
+	c := analytics.NewPrometheusCollector("app")
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream:  "test",
+		Sink:    &sink{},
+		Metrics: c,
+	})
+	defer a.Close()
+	c.Observe(a)
+
+	a.Track("one", nil)
+	a.Track("two", nil)
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	a.Track("three", nil)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range m.GetLabel() {
+				name += ":" + label.GetValue()
+			}
+			values[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+
+	expect := map[string]float64{
+		"app_analytics_events_tracked_total":  3,
+		"app_analytics_events_flushed_total":  2,
+		"app_analytics_flushes_total:success": 1,
+		"app_analytics_queue_events":          1,
+	}
+	for name, v := range expect {
+		if values[name] != v {
+			t.Fatalf("expected %s to be %v, got %v", name, v, values[name])
+		}
+	}
+
+	if _, ok := values["app_analytics_last_flush_age_seconds"]; !ok {
+		t.Fatal("expected the last flush age")
+	}
+}
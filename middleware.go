@@ -0,0 +1,74 @@
+package analytics
+
+import (
+	"context"
+
+	"github.com/apex/log"
+)
+
+// TrackFunc handles a tracked event.
+type TrackFunc func(event *Event) error
+
+// FlushFunc handles a batch of events being flushed.
+type FlushFunc func(ctx context.Context, events []*Event) error
+
+// Middleware wraps tracking and flushing, for enrichment, redaction,
+// filtering, metrics and so on. Not calling `next` drops the event(s).
+// Either function may be nil. Flush middleware runs on the batches sent
+// by Flush, not on events sent directly with TrackNow.
+type Middleware struct {
+	Track func(next TrackFunc) TrackFunc
+	Flush func(next FlushFunc) FlushFunc
+}
+
+// Filter returns false to drop an event before it's written.
+type Filter func(event *Event) bool
+
+// track runs the event through the filters, sampling and track
+// middleware, ending with fn. The first middleware is the outermost.
+func (a *Analytics) track(event *Event, fn TrackFunc) error {
+	for _, filter := range a.Filters {
+		if !filter(event) {
+			a.Metrics.Dropped(1)
+			return nil
+		}
+	}
+
+	if !a.sample(event) {
+		a.Metrics.Dropped(1)
+		return nil
+	}
+
+	for i := len(a.Middleware) - 1; i >= 0; i-- {
+		if m := a.Middleware[i]; m.Track != nil {
+			fn = m.Track(fn)
+		}
+	}
+	return fn(event)
+}
+
+// dryRun logs the events rather than sending them.
+func (a *Analytics) dryRun(ctx context.Context, events []*Event) error {
+	a.Log.WithField("events", len(events)).Info("dry run, not sending events")
+	for _, event := range events {
+		a.Log.WithFields(log.Fields{
+			"id":    event.ID,
+			"event": event.Event,
+		}).Debug("dry run")
+	}
+	return nil
+}
+
+// send runs the events through the flush middleware, ending with the sink.
+func (a *Analytics) send(ctx context.Context, events []*Event) error {
+	fn := FlushFunc(a.dryRun)
+	if !a.DryRun {
+		fn = a.Sink.Send
+	}
+	for i := len(a.Middleware) - 1; i >= 0; i-- {
+		if m := a.Middleware[i]; m.Flush != nil {
+			fn = m.Flush(fn)
+		}
+	}
+	return fn(ctx, events)
+}
@@ -0,0 +1,166 @@
+package analytics
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+)
+
+// Option configures Analytics.
+type Option func(*Config)
+
+// WithSession sets the AWS session credentials.
+func WithSession(session *session.Session) Option {
+	return func(c *Config) {
+		c.Session = session
+	}
+}
+
+// WithClient sets the Firehose client.
+func WithClient(client firehoseiface.FirehoseAPI) Option {
+	return func(c *Config) {
+		c.Client = client
+	}
+}
+
+// WithDir sets the directory we'll use. Defaults to the stream name.
+func WithDir(dir string) Option {
+	return func(c *Config) {
+		c.Dir = dir
+	}
+}
+
+// WithSharedID shares the anonymous ID between streams using the same Dir.
+func WithSharedID() Option {
+	return func(c *Config) {
+		c.ShareID = true
+	}
+}
+
+// WithPath sets the directory we'll use, instead of a directory
+// within the platform's config directory.
+func WithPath(path string) Option {
+	return func(c *Config) {
+		c.Path = path
+	}
+}
+
+// WithPrefix prefixes the events with a string.
+func WithPrefix(prefix string) Option {
+	return func(c *Config) {
+		c.Prefix = prefix
+	}
+}
+
+// WithLogger sets the logger.
+func WithLogger(log log.Interface) Option {
+	return func(c *Config) {
+		c.Log = log
+	}
+}
+
+// WithSink sets the sink events are delivered to.
+func WithSink(sink Sink) Option {
+	return func(c *Config) {
+		c.Sink = sink
+	}
+}
+
+// WithStore sets the store for queued events.
+func WithStore(store Store) Option {
+	return func(c *Config) {
+		c.Store = store
+	}
+}
+
+// WithMemory keeps events and state in memory, never touching disk.
+func WithMemory() Option {
+	return func(c *Config) {
+		c.Memory = true
+	}
+}
+
+// WithBackoff sets the backoff between retries of failed records.
+func WithBackoff(backoff Backoff) Option {
+	return func(c *Config) {
+		c.Backoff = backoff
+	}
+}
+
+// WithParallelism sends up to `n` batches of a backlog at once.
+func WithParallelism(n int) Option {
+	return func(c *Config) {
+		c.Parallelism = n
+	}
+}
+
+// WithFlushOnClose does a best-effort flush before closing, bounded
+// by `timeout`. A zero timeout uses the default.
+func WithFlushOnClose(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.FlushOnClose = true
+		c.FlushTimeout = timeout
+	}
+}
+
+// WithMaxAttempts moves events to the dead letters after failing
+// to send them `n` flushes in a row.
+func WithMaxAttempts(n int) Option {
+	return func(c *Config) {
+		c.MaxAttempts = n
+	}
+}
+
+// WithBreaker skips flushes for `cooldown` after `n` fail in a row.
+func WithBreaker(n int, cooldown time.Duration) Option {
+	return func(c *Config) {
+		c.Breaker = n
+		c.Cooldown = cooldown
+	}
+}
+
+// WithMaxQueue limits the queue on disk to `bytes` and `events`,
+// either of which can be zero for no limit.
+func WithMaxQueue(bytes int64, events int) Option {
+	return func(c *Config) {
+		c.MaxQueueSize = bytes
+		c.MaxQueueEvents = events
+	}
+}
+
+// WithSampleRate samples all events at `rate`, between 0 and 1.
+func WithSampleRate(rate float64) Option {
+	return func(c *Config) {
+		c.SampleRate = rate
+	}
+}
+
+// WithMarshaler sets how each event is serialized into a record.
+func WithMarshaler(marshaler Marshaler) Option {
+	return func(c *Config) {
+		c.Marshaler = marshaler
+	}
+}
+
+// WithEncryptionKey encrypts events, traits and the group on disk.
+func WithEncryptionKey(key []byte) Option {
+	return func(c *Config) {
+		c.EncryptionKey = key
+	}
+}
+
+// WithMetrics sets where the library reports its own health.
+func WithMetrics(metrics Metrics) Option {
+	return func(c *Config) {
+		c.Metrics = metrics
+	}
+}
+
+// WithErrorHandler is called when tracking or flushing fails.
+func WithErrorHandler(fn func(err error)) Option {
+	return func(c *Config) {
+		c.OnError = fn
+	}
+}
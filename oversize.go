@@ -0,0 +1,226 @@
+package analytics
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/apex/log"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/pkg/errors"
+)
+
+// Firehose rejects records over 1000KB
+const maxEventSize = 1000 * 1024
+
+// OversizePolicy decides what happens to events over the maximum size.
+type OversizePolicy int
+
+// Oversize policies
+const (
+	OversizeDrop     OversizePolicy = iota // Drop the event with a logged warning
+	OversizeTruncate                       // Shorten the largest strings, then remove the largest fields, until it fits
+	OversizeSplit                          // Split the body into continuation events
+)
+
+// fit the event within the maximum size, applying the oversize
+// policy if it's over. Split events are returned as several events.
+func (a *Analytics) fit(event *Event) ([]*Event, error) {
+	size, err := a.recordSize(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if size <= a.MaxEventSize {
+		return []*Event{event}, nil
+	}
+
+	ctx := a.Log.WithFields(log.Fields{
+		"event":    event.Event,
+		"size":     size,
+		"max_size": a.MaxEventSize,
+	})
+
+	var events []*Event
+	switch a.Oversize {
+	case OversizeTruncate:
+		ctx.Warn("truncating oversized event")
+		events, err = truncate(event, a.MaxEventSize, a.recordSize)
+	case OversizeSplit:
+		ctx.Warn("splitting oversized event")
+		events, err = split(event, a.MaxEventSize, a.recordSize)
+	}
+
+	if err != nil {
+		return nil, err
+	} else if len(events) == 0 {
+		ctx.Warn("dropping oversized event")
+	}
+
+	return events, nil
+}
+
+// recordSize returns the size of the event's record, marshaled the
+// way the sink will send it.
+func (a *Analytics) recordSize(event *Event) (int, error) {
+	s, ok := a.Sink.(*FirehoseSink)
+	if !ok || s.Marshaler == nil && s.Partition == nil {
+		record, err := json.Marshal(event)
+		if err != nil {
+			return 0, errors.Wrap(err, "marshal error")
+		}
+		return len(record), nil
+	}
+
+	if m, ok := s.Marshaler.(sizer); ok && s.Partition == nil {
+		return m.Size(event)
+	}
+
+	// tracking has no context, and sizers cover the marshalers that
+	// need the network
+	record, err := s.marshal(context.Background(), event)
+	if err != nil {
+		return 0, err
+	}
+	return len(record), nil
+}
+
+// ellipsis ends truncated strings.
+const ellipsis = "…"
+
+// truncate shortens the event until it fits, marking it with
+// `truncated: true`, which replaces any truncated field of its own.
+// The largest fields go first: strings are cut short and other values
+// are removed. Events that still don't fit are dropped.
+func truncate(event *Event, max int, size func(*Event) (int, error)) ([]*Event, error) {
+	type field struct {
+		key  string
+		size int
+	}
+
+	var fields []field
+	for k, v := range event.Body {
+		if k == "truncated" {
+			continue
+		}
+		b, _ := json.Marshal(v)
+		fields = append(fields, field{k, len(b)})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].size > fields[j].size
+	})
+
+	body := Body{}
+	for k, v := range event.Body {
+		body[k] = v
+	}
+	body["truncated"] = true
+
+	truncated := &Event{
+		ID:        event.ID,
+		Seq:       event.Seq,
+		Timestamp: event.Timestamp,
+		Event:     event.Event,
+		Body:      body,
+		offset:    event.offset,
+	}
+
+	for _, f := range fields {
+		n, err := size(truncated)
+		if err != nil {
+			return nil, err
+		} else if n <= max {
+			return []*Event{truncated}, nil
+		}
+
+		// escaping means cutting the excess bytes is always enough
+		if s, ok := body[f.key].(string); ok {
+			if keep := len(s) - (n - max) - len(ellipsis); keep > 0 {
+				body[f.key] = cut(s, keep) + ellipsis
+				continue
+			}
+		}
+
+		delete(body, f.key)
+	}
+
+	if n, err := size(truncated); err != nil {
+		return nil, err
+	} else if n <= max {
+		return []*Event{truncated}, nil
+	}
+
+	return nil, nil
+}
+
+// cut the string to at most n bytes, on a rune boundary.
+func cut(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// split the body into continuation events that share an id. Each
+// part is identified as <id>-<part>. The
+// body is JSON encoded then base64 encoded across the parts:
+//
+//	{ "continuation": "<id>", "part": 1, "parts": 3, "data": "..." }
+func split(event *Event, max int, size func(*Event) (int, error)) ([]*Event, error) {
+	data, err := json.Marshal(event.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	// parts share the event's id
+	id := event.ID
+	if id == "" {
+		id, err = uuid.GenerateUUID()
+		if err != nil {
+			return nil, errors.Wrap(err, "generating continuation id")
+		}
+	}
+
+	part := func(i, parts int, data []byte) *Event {
+		return &Event{
+			ID:        fmt.Sprintf("%s-%d", id, i),
+			Seq:       event.Seq,
+			Timestamp: event.Timestamp,
+			Event:     event.Event,
+			Body: Body{
+				"continuation": id,
+				"part":         i,
+				"parts":        parts,
+				"data":         base64.StdEncoding.EncodeToString(data),
+			},
+		}
+	}
+
+	// leave room for the envelope, as the sink marshals it, then
+	// account for base64's growth
+	overhead, err := size(part(math.MaxInt32, math.MaxInt32, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := (max - overhead) / 4 * 3
+	if chunk <= 0 {
+		return nil, nil
+	}
+
+	parts := (len(data) + chunk - 1) / chunk
+	events := make([]*Event, 0, parts)
+	for i := 0; i < parts; i++ {
+		end := (i + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		events = append(events, part(i+1, parts, data[i*chunk:end]))
+	}
+
+	return events, nil
+}
@@ -0,0 +1,66 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Partitioner returns the partition keys of an event, which are added to
+// its record as "partition_keys" for Firehose dynamic partitioning. The
+// stream's inline parsing can then use queries like .partition_keys.date.
+type Partitioner func(event *Event) map[string]string
+
+// PartitionByEventDate partitions records by the event's name and the
+// YYYY-MM-DD day it happened.
+func PartitionByEventDate(event *Event) map[string]string {
+	t, err := parseTimestamp(event.Timestamp)
+	if err != nil {
+		t = time.Now()
+	}
+
+	return map[string]string{
+		"event": event.Event,
+		"date":  t.UTC().Format("2006-01-02"),
+	}
+}
+
+// partitioned event, with its keys alongside the event's fields.
+type partitioned struct {
+	*Event
+	PartitionKeys map[string]string `json:"partition_keys"`
+}
+
+// marshalPartitioned marshals the event with its partition keys.
+func marshalPartitioned(event *Event, partition Partitioner) ([]byte, error) {
+	return json.Marshal(partitioned{event, partition(event)})
+}
+
+// addPartitionKeys adds the event's partition keys to a record marshaled
+// as a JSON object, e.g. by CloudEvents or Flatten, keeping its fields
+// in order. Records that aren't JSON objects can't be partitioned.
+func addPartitionKeys(record []byte, event *Event, partition Partitioner) ([]byte, error) {
+	record = bytes.TrimSpace(record)
+	if len(record) < 2 || record[0] != '{' || record[len(record)-1] != '}' {
+		return nil, errors.New("partition keys can only be added to JSON object records")
+	}
+
+	keys, err := json.Marshal(partition(event))
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	body := bytes.TrimSpace(record[1 : len(record)-1])
+	out := make([]byte, 0, len(record)+len(keys)+20)
+	out = append(out, '{')
+	if len(body) > 0 {
+		out = append(out, body...)
+		out = append(out, ',')
+	}
+	out = append(out, `"partition_keys":`...)
+	out = append(out, keys...)
+	out = append(out, '}')
+	return out, nil
+}
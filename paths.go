@@ -0,0 +1,305 @@
+package analytics
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// get the path to the state, like the queued events. On Linux that's
+// $XDG_STATE_HOME, elsewhere it's the same as the config.
+func getStatePath(paths ...string) (string, error) {
+	if runtime.GOOS != "linux" {
+		return getPath(paths...)
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" {
+		base = path.Join(home, ".local", "state")
+	}
+
+	ps := append([]string{base}, paths...)
+	return path.Join(ps...), nil
+}
+
+// migrateState moves the state that older versions kept alongside the
+// config into the state directory.
+func (a *Analytics) migrateState() {
+	if a.stateRoot == a.root {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(a.root)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !stateFiles[name] && !strings.HasPrefix(name, "events") {
+			continue
+		}
+
+		from := filepath.Join(a.root, name)
+
+		// locks are recreated as needed
+		if strings.HasSuffix(name, ".lock") {
+			os.Remove(from)
+			continue
+		}
+
+		to := filepath.Join(a.stateRoot, name)
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(a.stateRoot, a.DirMode); err != nil {
+			a.Log.WithError(err).Debug("error creating state dir")
+			return
+		}
+
+		if err := os.Rename(from, to); err != nil {
+			a.Log.WithError(err).WithField("file", name).Debug("error migrating state")
+		}
+	}
+}
+
+// migrateDir moves the files that older versions kept directly in a
+// shared Dir into the stream's subdirectory. The config, like the id,
+// is copied so every stream keeps the same identity. The state, like
+// the queued events, is moved so it's only sent once.
+func (a *Analytics) migrateDir(root, stateRoot string) {
+	for _, dirs := range [][2]string{{root, a.root}, {stateRoot, a.stateRoot}} {
+		from, to := dirs[0], dirs[1]
+
+		entries, err := ioutil.ReadDir(from)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasSuffix(name, ".lock") || strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+
+			dst := filepath.Join(to, name)
+			if _, err := os.Stat(dst); err == nil {
+				continue
+			}
+
+			if err := os.MkdirAll(to, a.DirMode); err != nil {
+				a.Log.WithError(err).Debug("error creating stream dir")
+				return
+			}
+
+			src := filepath.Join(from, name)
+			if stateFiles[name] || strings.HasPrefix(name, "events") {
+				err = os.Rename(src, dst)
+			} else {
+				err = copyFile(src, dst, a.FileMode)
+			}
+
+			if err != nil {
+				a.Log.WithError(err).WithField("file", name).Debug("error migrating to stream dir")
+			}
+		}
+	}
+}
+
+// Migrate moves the id, traits, group, opt-out and queued events from
+// `oldDir` to this instance's directory, for when an application renames
+// its stream or Dir. Like Dir, `oldDir` is relative to the config and
+// state directories. If it was shared, the stream's subdirectory is
+// migrated. The old files take precedence over any created since, so the
+// user keeps their identity and choice. Only the files that are moved are
+// removed, along with the old directory if that leaves it empty.
+func (a *Analytics) Migrate(oldDir string) error {
+	if a.store == nil {
+		return errors.New("no store")
+	}
+
+	if err := checkDir(oldDir); err != nil {
+		return err
+	}
+
+	if a.Memory {
+		return nil
+	}
+
+	root, err := streamDir(getPath, oldDir, a.Stream)
+	if err != nil {
+		return err
+	}
+
+	stateRoot, err := streamDir(getStatePath, oldDir, a.Stream)
+	if err != nil {
+		return err
+	}
+
+	if root == a.root || stateRoot == a.stateRoot {
+		return nil
+	}
+
+	dirs := []string{stateRoot}
+	if root != stateRoot {
+		dirs = append(dirs, root)
+	}
+
+	if err := a.mkdir(); err != nil {
+		return err
+	}
+
+	// the old queue is appended to this one
+	for _, dir := range dirs {
+		if err := a.migrateEvents(filepath.Join(dir, "events")); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, "events") || strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+
+			// locks are recreated as needed
+			if strings.HasSuffix(name, ".lock") {
+				os.Remove(filepath.Join(dir, name))
+				continue
+			}
+
+			// keep this instance's state, but the old config wins
+			to := a.path(name)
+			if _, err := os.Stat(to); err == nil && stateFiles[name] {
+				continue
+			}
+
+			if err := os.Rename(filepath.Join(dir, name), to); err != nil {
+				return errors.Wrapf(err, "moving %s", name)
+			}
+		}
+	}
+
+	// anything left over, like corrupt events, keeps the directory
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+
+	// reload the migrated identity and opt-out
+	consent, err := a.Consent()
+	if err != nil {
+		consent = ConsentOff
+	}
+	a.apply(consent)
+
+	return nil
+}
+
+// migrateEvents appends the events queued at `path` to this instance's
+// store, then removes them from the old queue.
+func (a *Analytics) migrateEvents(path string) error {
+	old := newFileStore(path, a.FileMode)
+	old.aead = a.aead
+	old.log = a.Log
+
+	events, err := old.ReadBatch(0)
+	if err != nil {
+		old.Close()
+		return errors.Wrap(err, "reading events")
+	}
+
+	if len(events) > 0 {
+		if err := a.store.Append(events...); err != nil {
+			old.Close()
+			return errors.Wrap(err, "appending events")
+		}
+
+		if err := old.Remove(len(events)); err != nil {
+			old.Close()
+			return errors.Wrap(err, "removing events")
+		}
+	}
+
+	if err := old.Close(); err != nil {
+		return err
+	}
+
+	// locks are recreated as needed
+	os.Remove(path + ".lock")
+	os.Remove(path + ".flush.lock")
+	return nil
+}
+
+// checkDir returns an error unless `dir` is relative to the config
+// directory, so migrating it can't touch anything outside of it.
+func checkDir(dir string) error {
+	clean := filepath.Clean(dir)
+	switch {
+	case clean == ".":
+		return errors.New("missing dir")
+	case filepath.IsAbs(clean):
+		return errors.Errorf("dir %q must be relative", dir)
+	case clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)):
+		return errors.Errorf("dir %q must be inside the config directory", dir)
+	}
+
+	return nil
+}
+
+// streamDir returns the path to `dir`, or to the stream's subdirectory
+// if `dir` was shared between streams.
+func streamDir(get func(...string) (string, error), dir, stream string) (string, error) {
+	root, err := get(dir)
+	if err != nil {
+		return "", err
+	}
+
+	sub := filepath.Join(root, stream)
+	if info, err := os.Stat(sub); err == nil && info.IsDir() {
+		return sub, nil
+	}
+
+	return root, nil
+}
+
+// copyFile copies src to dst.
+func copyFile(src, dst string, mode os.FileMode) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dst, b, mode)
+}
+
+// userConfigDir returns the config directory on other platforms,
+// falling back to ~/.config and then the temporary directory.
+func userConfigDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return dir
+	}
+
+	if home, err := homedir.Dir(); err == nil {
+		return path.Join(home, ".config")
+	}
+
+	return path.Join(os.TempDir(), "config")
+}
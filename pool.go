@@ -0,0 +1,72 @@
+package analytics
+
+import "sync"
+
+// pool sends batches with up to n workers at once.
+type pool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+	err error
+}
+
+// newPool returns a pool of n workers, at least one.
+func newPool(n int) *pool {
+	if n < 1 {
+		n = 1
+	}
+	return &pool{sem: make(chan struct{}, n)}
+}
+
+// do runs fn once a worker is free, returning the first error so far so
+// the caller can stop. With a single worker fn runs inline, in order.
+func (p *pool) do(fn func() error) error {
+	if cap(p.sem) == 1 {
+		if err := fn(); err != nil {
+			p.fail(err)
+		}
+		return p.first()
+	}
+
+	p.sem <- struct{}{}
+	if err := p.first(); err != nil {
+		<-p.sem
+		return err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+
+		if err := fn(); err != nil {
+			p.fail(err)
+		}
+	}()
+
+	return nil
+}
+
+// wait for the workers, returning the first error.
+func (p *pool) wait() error {
+	p.wg.Wait()
+	return p.first()
+}
+
+// fail records err, if it's the first.
+func (p *pool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// first returns the first error.
+func (p *pool) first() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -0,0 +1,103 @@
+package analytics
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// purger is implemented by stores that can clear their queue at once,
+// including any corrupt events.
+type purger interface {
+	Purge() error
+}
+
+// Purge clears the pending events, for "clear my telemetry" commands and
+// recovering from a poisoned queue. The events are archived first when
+// Config.Archive is set.
+func (a *Analytics) Purge() error {
+	return a.purge(a.Archive > 0)
+}
+
+// purge the pending events, archiving them first if `archive` is set.
+func (a *Analytics) purge(archive bool) error {
+	if a.store == nil {
+		return errors.New("no store")
+	}
+
+	// hold the lock so a flush can't send them as they're purged
+	if l, ok := a.store.(locker); ok {
+		if err := l.Lock(); err != nil {
+			return errors.Wrap(err, "locking")
+		}
+		defer l.Unlock()
+	}
+
+	if archive {
+		events, err := a.store.ReadBatch(0)
+		if err != nil {
+			return errors.Wrap(err, "reading events")
+		}
+
+		if len(events) > 0 {
+			if err := a.archive(events); err != nil {
+				return errors.Wrap(err, "archiving events")
+			}
+		}
+	}
+
+	if p, ok := a.store.(purger); ok {
+		if err := p.Purge(); err != nil {
+			return errors.Wrap(err, "purging events")
+		}
+	} else {
+		n, err := a.store.Size()
+		if err != nil {
+			return errors.Wrap(err, "reading events")
+		}
+
+		if err := a.store.Remove(n); err != nil {
+			return errors.Wrap(err, "removing events")
+		}
+	}
+
+	return a.clearCheckpoint()
+}
+
+// Purge removes the segments and events file, dropping any
+// buffered events.
+func (s *fileStore) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush.lock(); err != nil {
+		return err
+	}
+	defer s.flush.unlock()
+
+	if err := s.lock.lock(); err != nil {
+		return err
+	}
+	defer s.lock.unlock()
+
+	s.buf = nil
+	s.buffered = 0
+	s.unsynced = 0
+	if err := s.release(); err != nil {
+		return err
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return errors.Wrap(err, "listing segments")
+	}
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.counts, path)
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package analytics
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// sampleRate returns the sample rate for the event, preferring
+// the per-event rate over the global one.
+func (a *Analytics) sampleRate(event *Event) float64 {
+	name := strings.TrimPrefix(event.Event, a.Prefix)
+	if rate, ok := a.SampleRates[name]; ok {
+		return rate
+	}
+
+	if a.SampleRate > 0 {
+		return a.SampleRate
+	}
+
+	return 1
+}
+
+// sample returns false if the event should be dropped. Sampled
+// events record their `sample_rate` so counts can be reweighted.
+func (a *Analytics) sample(event *Event) bool {
+	rate := a.sampleRate(event)
+	if rate >= 1 {
+		return true
+	}
+
+	if rand.Float64() >= rate {
+		return false
+	}
+
+	event.Body["sample_rate"] = rate
+	return true
+}
@@ -0,0 +1,75 @@
+package analytics
+
+// Upgrade migrates queued events written with an older schema version,
+// for example renaming a field. Upgrades run at flush time in order of
+// their From version until the event is at the current SchemaVersion.
+type Upgrade struct {
+	Event   string             // Event name to upgrade, including any Prefix. Empty upgrades every event
+	From    int                // From is the schema version the upgrade applies to
+	Upgrade func(*Event) error // Upgrade the event to the next version
+}
+
+// attach the schema version to the body.
+func (a *Analytics) attachSchema(body Body) {
+	if a.SchemaVersion > 0 && body["schema_version"] == nil {
+		body.Set("schema_version", a.SchemaVersion)
+	}
+}
+
+// schemaVersion of the event, 0 if it predates schema versions.
+func schemaVersion(event *Event) int {
+	switch v := event.Body["schema_version"].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// upgrade the events to the current schema version, dropping those
+// that fail to upgrade.
+func (a *Analytics) upgrade(events []*Event) []*Event {
+	if a.SchemaVersion <= 0 {
+		return events
+	}
+
+	upgraded := events[:0:0]
+	for _, event := range events {
+		if err := a.upgradeEvent(event); err != nil {
+			a.Log.WithError(err).WithField("event", event.Event).Debug("error upgrading event, dropping it")
+			a.Metrics.Dropped(1)
+			continue
+		}
+		upgraded = append(upgraded, event)
+	}
+
+	return upgraded
+}
+
+// upgradeEvent runs the event's upgrades from its version to the current one.
+func (a *Analytics) upgradeEvent(event *Event) error {
+	version := schemaVersion(event)
+	if version >= a.SchemaVersion {
+		return nil
+	}
+
+	for v := version; v < a.SchemaVersion; v++ {
+		for _, u := range a.Upgrades {
+			if u.From != v || (u.Event != "" && u.Event != event.Event) {
+				continue
+			}
+
+			if err := u.Upgrade(event); err != nil {
+				return err
+			}
+		}
+	}
+
+	if event.Body == nil {
+		event.Body = Body{}
+	}
+	event.Body["schema_version"] = a.SchemaVersion
+	return nil
+}
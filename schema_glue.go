@@ -0,0 +1,350 @@
+package analytics
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/pkg/errors"
+)
+
+// GlueSchema validates and serializes events against a JSON schema in
+// the AWS Glue Schema Registry. Set it as the Config's Marshaler, along
+// with RawRecords, so records carry the registry's header and events that
+// don't match the schema are dropped at flush time rather than sent.
+//
+// Validation covers the common JSON Schema keywords: type, required,
+// properties, additionalProperties, items, enum and const. Other keywords
+// that only constrain a value, like format, pattern or minimum, are
+// ignored. Schemas that compose or reference subschemas, like $ref or
+// oneOf, are rejected rather than checked against part of the schema.
+type GlueSchema struct {
+	Session  *session.Session  // Session credentials for AWS
+	Client   glueiface.GlueAPI // Client for Glue. Defaults to one created from Session
+	Registry string            // Registry holding the schema
+	Schema   string            // Schema name
+	Version  int64             // Version of the schema. Defaults to the latest
+
+	mu         sync.Mutex
+	id         []byte                 // id of the schema version
+	definition map[string]interface{} // definition of the schema
+}
+
+// Validate the event against the schema.
+func (g *GlueSchema) Validate(ctx context.Context, event *Event) error {
+	if err := g.resolve(ctx); err != nil {
+		return err
+	}
+
+	value, err := jsonValue(event)
+	if err != nil {
+		return err
+	}
+
+	if err := validateJSON(g.definition, value, ""); err != nil {
+		return &invalidError{err}
+	}
+
+	return nil
+}
+
+// Marshal the event as JSON with the registry's header: the header
+// version, no compression and the schema version's id.
+func (g *GlueSchema) Marshal(event *Event) ([]byte, error) {
+	return g.MarshalContext(context.Background(), event)
+}
+
+// MarshalContext is Marshal with a context for fetching the schema.
+func (g *GlueSchema) MarshalContext(ctx context.Context, event *Event) ([]byte, error) {
+	if err := g.resolve(ctx); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	record := make([]byte, 0, 2+len(g.id)+len(data))
+	record = append(record, 3, 0)
+	record = append(record, g.id...)
+	return append(record, data...), nil
+}
+
+// Size of the event's record, without fetching the schema.
+func (g *GlueSchema) Size(event *Event) (int, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal error")
+	}
+
+	return 2 + 16 + len(data), nil
+}
+
+// resolve the schema version, once. The lock isn't held while fetching,
+// so a slow registry doesn't block other goroutines' contexts. Whichever
+// fetch finishes first wins.
+func (g *GlueSchema) resolve(ctx context.Context) error {
+	g.mu.Lock()
+	resolved := g.id != nil
+	g.mu.Unlock()
+
+	if resolved {
+		return nil
+	}
+
+	client := g.Client
+	if client == nil {
+		client = glue.New(g.Session)
+	}
+
+	version := &glue.SchemaVersionNumber{LatestVersion: aws.Bool(true)}
+	if g.Version > 0 {
+		version = &glue.SchemaVersionNumber{VersionNumber: aws.Int64(g.Version)}
+	}
+
+	output, err := client.GetSchemaVersionWithContext(ctx, &glue.GetSchemaVersionInput{
+		SchemaId: &glue.SchemaId{
+			RegistryName: aws.String(g.Registry),
+			SchemaName:   aws.String(g.Schema),
+		},
+		SchemaVersionNumber: version,
+	})
+	if err != nil {
+		return errors.Wrap(err, "getting schema version")
+	}
+
+	if format := aws.StringValue(output.DataFormat); format != glue.DataFormatJson {
+		return fmt.Errorf("unsupported schema format %q", format)
+	}
+
+	id, err := hex.DecodeString(strings.Replace(aws.StringValue(output.SchemaVersionId), "-", "", -1))
+	if err != nil || len(id) != 16 {
+		return fmt.Errorf("invalid schema version id %q", aws.StringValue(output.SchemaVersionId))
+	}
+
+	var definition map[string]interface{}
+	if err := json.Unmarshal([]byte(aws.StringValue(output.SchemaDefinition)), &definition); err != nil {
+		return errors.Wrap(err, "parsing schema")
+	}
+
+	if err := checkSchema(definition, ""); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.id == nil {
+		g.id = id
+		g.definition = definition
+	}
+	return nil
+}
+
+// jsonValue round-trips the event through JSON, so its values have
+// the same types a consumer would see.
+func jsonValue(event *Event) (interface{}, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, errors.Wrap(err, "unmarshal error")
+	}
+
+	return v, nil
+}
+
+// unsupportedKeywords compose, reference or apply subschemas in ways
+// validateJSON doesn't follow, so it would check the wrong structure.
+var unsupportedKeywords = map[string]bool{
+	"$ref":                  true,
+	"$dynamicRef":           true,
+	"allOf":                 true,
+	"anyOf":                 true,
+	"oneOf":                 true,
+	"not":                   true,
+	"if":                    true,
+	"then":                  true,
+	"else":                  true,
+	"dependencies":          true,
+	"dependentSchemas":      true,
+	"patternProperties":     true,
+	"prefixItems":           true,
+	"unevaluatedProperties": true,
+	"unevaluatedItems":      true,
+}
+
+// checkSchema rejects schemas whose structure validateJSON can't follow,
+// so events aren't passed without being checked. Keywords that only
+// constrain a value, like format or minimum, are ignored.
+func checkSchema(schema map[string]interface{}, path string) error {
+	for key, value := range schema {
+		if unsupportedKeywords[key] {
+			return fmt.Errorf("unsupported schema keyword %q at %s", key, jsonPath(path))
+		}
+
+		switch key {
+		case "properties":
+			properties, _ := value.(map[string]interface{})
+			for name, property := range properties {
+				if sub, ok := property.(map[string]interface{}); ok {
+					if err := checkSchema(sub, path+"."+name); err != nil {
+						return err
+					}
+				}
+			}
+		case "additionalProperties":
+			if sub, ok := value.(map[string]interface{}); ok {
+				if err := checkSchema(sub, path+".*"); err != nil {
+					return err
+				}
+			}
+		case "items":
+			// tuples aren't supported
+			if _, ok := value.([]interface{}); ok {
+				return fmt.Errorf("unsupported schema keyword %q at %s", key, jsonPath(path))
+			} else if sub, ok := value.(map[string]interface{}); ok {
+				if err := checkSchema(sub, path+"[]"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateJSON validates `value` against `schema`, returning the first
+// mismatch found.
+func validateJSON(schema map[string]interface{}, value interface{}, path string) error {
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		return fmt.Errorf("%s: expected %v", jsonPath(path), t)
+	}
+
+	// values are both decoded from JSON, so equal values have equal types
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, v := range enum {
+			if reflect.DeepEqual(v, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: expected one of %v", jsonPath(path), enum)
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		return fmt.Errorf("%s: expected %v", jsonPath(path), c)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, key := range required {
+				if _, ok := v[fmt.Sprint(key)]; !ok {
+					return fmt.Errorf("%s: missing %v", jsonPath(path), key)
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, property := range properties {
+			child, ok := v[key]
+			sub, isSchema := property.(map[string]interface{})
+			if !ok || !isSchema {
+				continue
+			}
+			if err := validateJSON(sub, child, path+"."+key); err != nil {
+				return err
+			}
+		}
+
+		for key, child := range v {
+			if _, ok := properties[key]; ok {
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: unexpected %s", jsonPath(path), key)
+				}
+			case map[string]interface{}:
+				if err := validateJSON(additional, child, path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for i, child := range v {
+			if err := validateJSON(items, child, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchesType checks `value` against a type or list of types.
+func matchesType(t interface{}, value interface{}) bool {
+	if types, ok := t.([]interface{}); ok {
+		for _, t := range types {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	default:
+		return true
+	}
+}
+
+// jsonPath of the root or a field.
+func jsonPath(path string) string {
+	if path == "" {
+		return "event"
+	}
+	return "event" + path
+}
@@ -0,0 +1,121 @@
+package analytics
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// seqBlock is how many sequence numbers are reserved at a time.
+const seqBlock = 100
+
+// init the lock on ~/<dir>/seq, shared by processes using the same dir.
+func (a *Analytics) initSeq() {
+	if a.Memory {
+		return
+	}
+
+	a.seqLock = &flock{path: a.path("seq") + ".lock", mode: a.FileMode}
+}
+
+// stamp the event with the next sequence number, reserving another
+// block of them once the last one's used up.
+func (a *Analytics) stamp(event *Event) {
+	if event.Seq != 0 {
+		return
+	}
+
+	if a.seq >= a.seqEnd {
+		if err := a.reserveSeq(); err != nil {
+			a.Log.WithError(err).Debug("error reserving seq")
+		}
+	}
+
+	a.seq++
+	event.Seq = a.seq
+}
+
+// reserveSeq advances ~/<dir>/seq by a block under its lock, so
+// processes sharing the dir never hand out the same number.
+func (a *Analytics) reserveSeq() error {
+	if a.seqLock != nil {
+		if err := a.seqLock.lock(); err != nil {
+			return err
+		}
+		defer a.seqLock.unlock()
+	}
+
+	seq, err := a.readSeq()
+	if err != nil {
+		return err
+	}
+
+	if seq < a.seq {
+		seq = a.seq
+	}
+
+	if err := a.writeSeq(seq + seqBlock); err != nil {
+		return err
+	}
+
+	a.seq = seq
+	a.seqEnd = seq + seqBlock
+	return nil
+}
+
+// releaseSeq hands back the unused part of the block, so the sequence
+// carries on without a gap in the next run. It's kept if another process
+// has reserved a block since.
+func (a *Analytics) releaseSeq() error {
+	if a.seq >= a.seqEnd {
+		return nil
+	}
+
+	if a.seqLock != nil {
+		if err := a.seqLock.lock(); err != nil {
+			return err
+		}
+		defer a.seqLock.unlock()
+	}
+
+	seq, err := a.readSeq()
+	if err != nil {
+		return err
+	} else if seq != a.seqEnd {
+		return nil
+	}
+
+	if err := a.writeSeq(a.seq); err != nil {
+		return err
+	}
+
+	a.seqEnd = a.seq
+	return nil
+}
+
+// readSeq reads the last reserved number from ~/<dir>/seq.
+func (a *Analytics) readSeq() (uint64, error) {
+	b, err := a.readFile("seq")
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "reading seq")
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing seq")
+	}
+
+	return seq, nil
+}
+
+// writeSeq saves the last reserved number to ~/<dir>/seq.
+func (a *Analytics) writeSeq(seq uint64) error {
+	if err := a.writeFile("seq", []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return errors.Wrap(err, "saving seq")
+	}
+	return nil
+}
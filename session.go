@@ -0,0 +1,33 @@
+package analytics
+
+import (
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// init the session, which lasts as long as the process.
+func (a *Analytics) initSession() {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		a.Log.WithError(err).Debug("error generating session id")
+		return
+	}
+
+	a.session = id
+}
+
+// SessionID returns the ID attached to every event tracked by this
+// instance, so the events of a single run can be grouped together.
+func (a *Analytics) SessionID() string {
+	return a.session
+}
+
+// attach the session to the body.
+func (a *Analytics) attachSession(body Body) {
+	if a.session == "" {
+		return
+	}
+
+	if body["session_id"] == nil {
+		body.Set("session_id", a.session)
+	}
+}
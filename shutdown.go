@@ -0,0 +1,66 @@
+package analytics
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Shutdown waits for any flush in flight, flushes the remaining events
+// and closes the files, giving up on flushing when the context is done.
+// Events that couldn't be sent stay queued for the next run.
+func (a *Analytics) Shutdown(ctx context.Context) error {
+	var err error
+
+	if a.active() {
+		// wait for the flush in flight, so this one sends what's left
+		if werr := a.singleFlight(ctx, func() error { return nil }); werr != nil {
+			a.Log.WithError(werr).Debug("error waiting for flush")
+		}
+
+		if ferr := a.FlushContext(ctx); ferr != nil {
+			err = errors.Wrap(ferr, "flushing")
+		}
+	}
+
+	if cerr := a.close(); cerr != nil && err == nil {
+		err = errors.Wrap(cerr, "closing")
+	}
+
+	return err
+}
+
+// ShutdownOnSignal shuts down within `timeout` once the process gets
+// SIGINT or SIGTERM, then raises the signal again so the process exits
+// as it otherwise would. Call stop to stop listening for the signals.
+func (a *Analytics) ShutdownOnSignal(timeout time.Duration) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-c:
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := a.Shutdown(ctx); err != nil {
+				a.Log.WithError(err).Debug("error shutting down")
+			}
+			cancel()
+
+			signal.Stop(c)
+			if p, err := os.FindProcess(os.Getpid()); err != nil || p.Signal(sig) != nil {
+				os.Exit(1)
+			}
+		case <-done:
+			signal.Stop(c)
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,418 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// PutRecordBatch accepts up to 500 records or 4MB per call
+	firehoseMaxRecords = 500
+	firehoseMaxBytes   = 4 * 1024 * 1024
+)
+
+// Sink delivers flushed events to a backend.
+type Sink interface {
+	Send(ctx context.Context, events []*Event) error
+}
+
+// PartialError is returned by sinks that sent some of the events,
+// so only the ones that failed are sent again.
+type PartialError struct {
+	Failed []*Event // Failed events that weren't sent
+	Err    error    // Err that caused them to fail
+}
+
+// Error implements error.
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d events failed: %s", len(e.Failed), e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *PartialError) Cause() error {
+	return e.Err
+}
+
+// eventSender is implemented by sinks that have a cheaper way to
+// send a single event than a batch.
+type eventSender interface {
+	SendEvent(ctx context.Context, event *Event) error
+}
+
+// sendEvent sends a single event, using SendEvent if the sink has it.
+func sendEvent(ctx context.Context, sink Sink, event *Event) error {
+	if s, ok := sink.(eventSender); ok {
+		return s.SendEvent(ctx, event)
+	}
+	return sink.Send(ctx, []*Event{event})
+}
+
+// FirehoseSink delivers events to an AWS Firehose delivery stream. It's
+// safe for concurrent use.
+type FirehoseSink struct {
+	Session    *session.Session          // Session credentials for AWS
+	Client     firehoseiface.FirehoseAPI // Client for Firehose. Defaults to one created from Session
+	Endpoint   string                    // Endpoint override, e.g. LocalStack (optional)
+	Region     string                    // Region override (optional)
+	RoleARN    string                    // RoleARN to assume before delivering (optional)
+	ExternalID string                    // ExternalID passed when assuming RoleARN (optional)
+	Stream     string                    // Stream we'll publish to on FH
+	Backoff    Backoff                   // Backoff between retries of failed records
+	Gzip       bool                      // Gzip each record, consumers can detect them by gzip's magic number 0x1f 0x8b
+	Aggregate  bool                      // Aggregate packs events into newline-delimited records of up to 1000KB, rather than one per record
+	Marshaler  Marshaler                 // Marshaler serializes each event. Defaults to JSON
+	Partition  Partitioner               // Partition adds partition_keys to each record when marshaling to JSON (optional)
+	Raw        bool                      // Raw sends each record without a trailing newline, so S3 can't delimit them (optional)
+	Metrics    Metrics                   // Metrics receives the bytes sent and records retried (optional)
+	Tracer     Tracer                    // Tracer starts a span for each PutRecordBatch call (optional)
+
+	// CreateStream creates the stream with S3Destination on the
+	// first send if it doesn't exist yet
+	CreateStream  bool
+	S3Destination *firehose.ExtendedS3DestinationConfiguration
+
+	mu    sync.Mutex
+	ready bool // stream is known to exist
+
+	once sync.Once
+	fh   firehoseiface.FirehoseAPI // fh client created on the first send
+}
+
+// Send the events to Firehose with PutRecordBatch.
+func (s *FirehoseSink) Send(ctx context.Context, events []*Event) error {
+	if s.Stream == "" {
+		return fmt.Errorf("missing stream name")
+	}
+
+	records, packed, err := s.records(ctx, events)
+	if err != nil {
+		return err
+	}
+
+	// setup the firehose client
+	fh := s.client()
+
+	if s.CreateStream {
+		s.mu.Lock()
+		if !s.ready {
+			if err := s.ensureStream(ctx, fh); err != nil {
+				s.mu.Unlock()
+				return err
+			}
+			s.ready = true
+		}
+		s.mu.Unlock()
+	}
+
+	// send the records in chunks that fit within the limits
+	var errs []error
+	var failed []*Event
+	chunks := firehoseChunks(records)
+	offset := 0
+
+	for _, chunk := range chunks {
+		indices, err := s.sendBatch(ctx, fh, chunk)
+		if err != nil {
+			errs = append(errs, err)
+			for _, i := range indices {
+				failed = append(failed, packed[offset+i]...)
+			}
+		}
+		s.metrics().Sent(sent(chunk, indices))
+		offset += len(chunk)
+	}
+
+	if len(errs) > 0 {
+		return &PartialError{
+			Failed: failed,
+			Err:    errors.Wrapf(errs[0], "%d of %d chunks failed", len(errs), len(chunks)),
+		}
+	}
+
+	return nil
+}
+
+// SendEvent sends a single event to Firehose with PutRecord.
+func (s *FirehoseSink) SendEvent(ctx context.Context, event *Event) error {
+	if s.Stream == "" {
+		return fmt.Errorf("missing stream name")
+	}
+
+	record, err := s.record(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client().PutRecordWithContext(ctx, &firehose.PutRecordInput{
+		DeliveryStreamName: aws.String(s.Stream),
+		Record:             &firehose.Record{Data: record},
+	})
+	if err != nil {
+		return errors.Wrap(err, "error sending record to firehose")
+	}
+
+	s.metrics().Sent(len(record))
+	return nil
+}
+
+// metrics returns the sink's metrics, discarding them if unset.
+func (s *FirehoseSink) metrics() Metrics {
+	if s.Metrics == nil {
+		return nopMetrics{}
+	}
+	return s.Metrics
+}
+
+// marshal the event with the sink's marshaler, JSON if unset, adding
+// the partition keys if there's a partitioner.
+func (s *FirehoseSink) marshal(ctx context.Context, event *Event) ([]byte, error) {
+	if s.Marshaler == nil && s.Partition != nil {
+		return marshalPartitioned(event, s.Partition)
+	} else if s.Marshaler == nil {
+		return json.Marshal(event)
+	}
+
+	var record []byte
+	var err error
+	if m, ok := s.Marshaler.(contextMarshaler); ok {
+		record, err = m.MarshalContext(ctx, event)
+	} else {
+		record, err = s.Marshaler.Marshal(event)
+	}
+	if err != nil || s.Partition == nil {
+		return record, err
+	}
+
+	return addPartitionKeys(record, event, s.Partition)
+}
+
+// tracer returns the sink's tracer, not tracing if unset.
+func (s *FirehoseSink) tracer() Tracer {
+	if s.Tracer == nil {
+		return nopTracer{}
+	}
+	return s.Tracer
+}
+
+// putRecordBatch calls PutRecordBatch within a span.
+func (s *FirehoseSink) putRecordBatch(ctx context.Context, fh firehoseiface.FirehoseAPI, records []*firehose.Record, attempt int) (*firehose.PutRecordBatchOutput, error) {
+	ctx, span := s.tracer().Start(ctx, "firehose.PutRecordBatch")
+	span.Set("stream", s.Stream)
+	span.Set("records", len(records))
+	span.Set("attempt", attempt)
+
+	output, err := fh.PutRecordBatchWithContext(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(s.Stream),
+		Records:            records,
+	})
+
+	if err == nil && output.FailedPutCount != nil {
+		span.Set("failed", int(*output.FailedPutCount))
+	}
+
+	span.End(err)
+	return output, err
+}
+
+// sent returns the bytes in the chunk, less the records that failed.
+func sent(chunk []*firehose.Record, failed []int) (n int) {
+	for _, record := range chunk {
+		n += len(record.Data)
+	}
+
+	for _, i := range failed {
+		n -= len(chunk[i].Data)
+	}
+
+	return n
+}
+
+// record encodes the event as the data of a Firehose record.
+func (s *FirehoseSink) record(ctx context.Context, event *Event) ([]byte, error) {
+	data, err := s.marshal(ctx, event)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal error")
+	}
+
+	// Firehose concatenates records, so delimit them
+	if !s.Raw {
+		data = append(data, '\n')
+	}
+
+	if !s.Gzip {
+		return data, nil
+	}
+
+	return gzipRecord(data)
+}
+
+// records encodes the events as Firehose records, returning the events
+// packed into each one so failed records can be mapped back to them.
+func (s *FirehoseSink) records(ctx context.Context, events []*Event) (records []*firehose.Record, packed [][]*Event, err error) {
+	if !s.Aggregate {
+		for _, event := range events {
+			data, err := s.record(ctx, event)
+			if err != nil {
+				return nil, nil, err
+			}
+			records = append(records, &firehose.Record{Data: data})
+			packed = append(packed, []*Event{event})
+		}
+		return records, packed, nil
+	}
+
+	var data []byte
+	var group []*Event
+
+	// add the newline-delimited events packed so far as a record
+	pack := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+
+		if s.Gzip {
+			var err error
+			if data, err = gzipRecord(data); err != nil {
+				return err
+			}
+		}
+
+		records = append(records, &firehose.Record{Data: data})
+		packed = append(packed, group)
+		data, group = nil, nil
+		return nil
+	}
+
+	for _, event := range events {
+		line, err := s.marshal(ctx, event)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "marshal error")
+		}
+		line = append(line, '\n')
+
+		if len(data)+len(line) > maxEventSize {
+			if err := pack(); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		data = append(data, line...)
+		group = append(group, event)
+	}
+
+	if err := pack(); err != nil {
+		return nil, nil, err
+	}
+
+	return records, packed, nil
+}
+
+// firehoseChunks splits records into PutRecordBatch-sized chunks.
+func firehoseChunks(records []*firehose.Record) (chunks [][]*firehose.Record) {
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < firehoseMaxRecords {
+			size += len(records[n].Data)
+			if n > 0 && size > firehoseMaxBytes {
+				break
+			}
+			n++
+		}
+		chunks = append(chunks, records[:n])
+		records = records[n:]
+	}
+	return chunks
+}
+
+// sendBatch sends a single chunk, retrying failed records. Returns
+// the indices of the records that weren't sent.
+func (s *FirehoseSink) sendBatch(ctx context.Context, fh firehoseiface.FirehoseAPI, records []*firehose.Record) ([]int, error) {
+	start := time.Now()
+
+	indices := make([]int, len(records))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	for attempt := 1; ; attempt++ {
+		output, err := s.putRecordBatch(ctx, fh, records, attempt)
+		if err != nil {
+			return indices, errors.Wrap(err, "error sending records to firehose")
+		} else if output.FailedPutCount == nil || *output.FailedPutCount == 0 {
+			return nil, nil
+		}
+
+		// retry the records that failed
+		newRecords := []*firehose.Record{}
+		newIndices := []int{}
+		for i, res := range output.RequestResponses {
+			if res.ErrorCode != nil {
+				newRecords = append(newRecords, records[i])
+				newIndices = append(newIndices, indices[i])
+			}
+		}
+		records, indices = newRecords, newIndices
+
+		delay, ok := s.Backoff.next(attempt, time.Since(start))
+		if !ok {
+			return indices, fmt.Errorf("couldn't send %d records after %d attempts", len(records), attempt)
+		}
+
+		if err := sleep(ctx, delay); err != nil {
+			return indices, errors.Wrap(err, "waiting to retry")
+		}
+
+		s.metrics().Retried(len(records))
+	}
+}
+
+// client returns the Firehose client, creating one from the
+// session, overrides and assumed role the first time if it wasn't
+// provided. It's reused so the assumed role's credentials are cached.
+func (s *FirehoseSink) client() firehoseiface.FirehoseAPI {
+	if s.Client != nil {
+		return s.Client
+	}
+
+	s.once.Do(func() {
+		s.fh = s.newClient()
+	})
+
+	return s.fh
+}
+
+// newClient creates a Firehose client from the session and overrides.
+func (s *FirehoseSink) newClient() firehoseiface.FirehoseAPI {
+	config := aws.NewConfig()
+	if s.Endpoint != "" {
+		config = config.WithEndpoint(s.Endpoint)
+	}
+	if s.Region != "" {
+		config = config.WithRegion(s.Region)
+	}
+	if s.RoleARN != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(s.Session, s.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if s.ExternalID != "" {
+				p.ExternalID = aws.String(s.ExternalID)
+			}
+		}))
+	}
+
+	return firehose.New(s.Session, config)
+}
+
+// bodyString returns the string value of key in the body, if any.
+func bodyString(body map[string]interface{}, key string) string {
+	s, _ := body[key].(string)
+	return s
+}
@@ -0,0 +1,160 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// PutLogEvents accepts up to 1MB per batch, counting
+	// 26 bytes of overhead for each event
+	cloudwatchMaxBytes    = 1024 * 1024
+	cloudwatchEventBytes  = 26
+	cloudwatchMaxEvents   = 10000
+	cloudwatchMaxSpan     = 24 * time.Hour
+	cloudwatchMaxAttempts = 3
+)
+
+// CloudWatchSink delivers events to a CloudWatch Logs log stream,
+// so they can be analyzed with CloudWatch Logs Insights. It's safe for
+// concurrent use, sends are serialized since each needs the stream's
+// latest sequence token.
+type CloudWatchSink struct {
+	Session   *session.Session                      // Session credentials for AWS
+	Client    cloudwatchlogsiface.CloudWatchLogsAPI // Client for CloudWatch Logs. Defaults to one created from Session
+	LogGroup  string                                // LogGroup we'll publish to
+	LogStream string                                // LogStream we'll publish to
+
+	mu    sync.Mutex
+	token *string // next sequence token
+}
+
+// Send the events to CloudWatch Logs with PutLogEvents.
+func (s *CloudWatchSink) Send(ctx context.Context, events []*Event) error {
+	if s.LogGroup == "" {
+		return fmt.Errorf("missing log group name")
+	} else if s.LogStream == "" {
+		return fmt.Errorf("missing log stream name")
+	}
+
+	var logs []*cloudwatchlogs.InputLogEvent
+	for _, event := range events {
+		msg, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrapf(err, "marshal error")
+		}
+
+		t, err := parseTimestamp(event.Timestamp)
+		if err != nil {
+			t = time.Now()
+		}
+
+		logs = append(logs, &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(string(msg)),
+			Timestamp: aws.Int64(t.UnixNano() / int64(time.Millisecond)),
+		})
+	}
+
+	// log events must be in chronological order
+	sort.SliceStable(logs, func(i, j int) bool {
+		return *logs[i].Timestamp < *logs[j].Timestamp
+	})
+
+	client := s.Client
+	if client == nil {
+		client = cloudwatchlogs.New(s.Session)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(logs) > 0 {
+		n := cloudwatchBatch(logs)
+		if err := s.put(ctx, client, logs[:n]); err != nil {
+			return err
+		}
+		logs = logs[n:]
+	}
+
+	return nil
+}
+
+// cloudwatchBatch returns how many logs fit in the next batch.
+func cloudwatchBatch(logs []*cloudwatchlogs.InputLogEvent) int {
+	size := 0
+	first := *logs[0].Timestamp
+	span := cloudwatchMaxSpan.Nanoseconds() / int64(time.Millisecond)
+
+	for i, event := range logs {
+		size += len(*event.Message) + cloudwatchEventBytes
+		if i > 0 && (size > cloudwatchMaxBytes || i >= cloudwatchMaxEvents || *event.Timestamp-first >= span) {
+			return i
+		}
+	}
+
+	return len(logs)
+}
+
+// put a batch, refreshing the sequence token if it's stale.
+func (s *CloudWatchSink) put(ctx context.Context, client cloudwatchlogsiface.CloudWatchLogsAPI, logs []*cloudwatchlogs.InputLogEvent) error {
+	for attempt := 1; ; attempt++ {
+		output, err := client.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(s.LogGroup),
+			LogStreamName: aws.String(s.LogStream),
+			LogEvents:     logs,
+			SequenceToken: s.token,
+		})
+		if err == nil {
+			s.token = output.NextSequenceToken
+			return nil
+		}
+
+		aerr, ok := err.(awserr.Error)
+		if !ok || attempt >= cloudwatchMaxAttempts {
+			return errors.Wrap(err, "error sending events to cloudwatch")
+		}
+
+		switch aerr.Code() {
+		case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+			if err := s.refreshToken(ctx, client); err != nil {
+				return err
+			}
+		case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+			// the batch made it, we just need the next token
+			return s.refreshToken(ctx, client)
+		default:
+			return errors.Wrap(err, "error sending events to cloudwatch")
+		}
+	}
+}
+
+// refreshToken looks up the stream's upload sequence token.
+func (s *CloudWatchSink) refreshToken(ctx context.Context, client cloudwatchlogsiface.CloudWatchLogsAPI) error {
+	output, err := client.DescribeLogStreamsWithContext(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(s.LogGroup),
+		LogStreamNamePrefix: aws.String(s.LogStream),
+	})
+	if err != nil {
+		return errors.Wrap(err, "describing log stream")
+	}
+
+	for _, stream := range output.LogStreams {
+		if aws.StringValue(stream.LogStreamName) == s.LogStream {
+			s.token = stream.UploadSequenceToken
+			return nil
+		}
+	}
+
+	return fmt.Errorf("log stream %q not found", s.LogStream)
+}
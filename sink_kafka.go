@@ -0,0 +1,78 @@
+//go:build kafka
+// +build kafka
+
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaProducer produces records, e.g. a *kgo.Client.
+type KafkaProducer interface {
+	ProduceSync(ctx context.Context, records ...*kgo.Record) kgo.ProduceResults
+}
+
+// KafkaSink produces events to a Kafka topic. It's only
+// available when building with `-tags kafka`.
+type KafkaSink struct {
+	Client KafkaProducer             // Client connected to the brokers
+	Topic  string                    // Topic we'll produce to
+	Key    func(event *Event) []byte // Key for each record. Defaults to KeyByEvent
+}
+
+// KeyByEvent keys records by the event name.
+func KeyByEvent(event *Event) []byte {
+	return []byte(event.Event)
+}
+
+// KeyByUser keys records by the user_id in the body, falling
+// back to the anonymous_id, so a user's events stay ordered.
+// Both are only attached once the user is identified, so events
+// tracked before Identify have no key and are spread across
+// partitions, without any ordering.
+func KeyByUser(event *Event) []byte {
+	for _, field := range []string{"user_id", "anonymous_id"} {
+		if id, ok := event.Body[field].(string); ok && id != "" {
+			return []byte(id)
+		}
+	}
+	return nil
+}
+
+// Send the events to Kafka, waiting until they're acknowledged.
+func (s *KafkaSink) Send(ctx context.Context, events []*Event) error {
+	if s.Client == nil {
+		return fmt.Errorf("missing kafka client")
+	} else if s.Topic == "" {
+		return fmt.Errorf("missing topic name")
+	}
+
+	key := s.Key
+	if key == nil {
+		key = KeyByEvent
+	}
+
+	records := make([]*kgo.Record, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrapf(err, "marshal error")
+		}
+		records = append(records, &kgo.Record{
+			Topic: s.Topic,
+			Key:   key(event),
+			Value: value,
+		})
+	}
+
+	if err := s.Client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		return errors.Wrap(err, "error producing records to kafka")
+	}
+
+	return nil
+}
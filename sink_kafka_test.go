@@ -0,0 +1,67 @@
+//go:build kafka
+// +build kafka
+
+package analytics_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matthewmueller/firehose-analytics"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type producer struct {
+	records []*kgo.Record
+}
+
+func (p *producer) ProduceSync(ctx context.Context, records ...*kgo.Record) kgo.ProduceResults {
+	var results kgo.ProduceResults
+	for _, r := range records {
+		p.records = append(p.records, r)
+		results = append(results, kgo.ProduceResult{Record: r})
+	}
+	return results
+}
+
+func TestKafkaSink(t *testing.T) {
+	home(t)
+	p := &producer{}
+	a := analytics.NewFromConfig(&analytics.Config{
+		Stream: "test",
+		Sink:   &analytics.KafkaSink{Client: p, Topic: "events", Key: analytics.KeyByUser},
+	})
+	a.Track("anonymous", nil)
+	a.Identify("user", nil)
+	a.Track("cool", nil)
+	a.Track("cool", analytics.Body{"user_id": "", "anonymous_id": "anon"})
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.records) != 4 {
+		t.Fatalf("expected a record per event, got %d", len(p.records))
+	}
+
+	// events before Identify have no user to key by
+	if p.records[0].Key != nil {
+		t.Fatalf("expected no key, got %q", p.records[0].Key)
+	}
+
+	// falling back to the anonymous id
+	if string(p.records[3].Key) != "anon" {
+		t.Fatalf("expected the anonymous id, got %q", p.records[3].Key)
+	}
+
+	r := p.records[2]
+	var event analytics.Event
+	if err := json.Unmarshal(r.Value, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Topic != "events" || string(r.Key) != "user" || event.Event != "cool" {
+		t.Fatalf("unexpected record %s %s %s", r.Topic, r.Key, r.Value)
+	}
+}
@@ -0,0 +1,133 @@
+package analytics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/pkg/errors"
+)
+
+// S3Sink uploads events to an S3 bucket as gzipped newline-delimited JSON.
+// Objects are partitioned by the day the events happened:
+//
+//	<prefix>/dt=YYYY-MM-DD/<unix>-<uuid>.json.gz
+type S3Sink struct {
+	Session *session.Session // Session credentials for AWS
+	Client  s3iface.S3API    // Client for S3. Defaults to one created from Session
+	Bucket  string           // Bucket we'll upload to
+	Prefix  string           // Prefix for the object keys (optional)
+}
+
+// Send the events to S3, one object per day. Returns a *PartialError
+// with the events of the days that failed, so the days that were
+// uploaded aren't uploaded again.
+func (s *S3Sink) Send(ctx context.Context, events []*Event) error {
+	if s.Bucket == "" {
+		return fmt.Errorf("missing bucket name")
+	}
+
+	// partition the events by day
+	days := map[string][]*Event{}
+	for _, event := range events {
+		day := partitionDay(event)
+		days[day] = append(days[day], event)
+	}
+
+	keys := make([]string, 0, len(days))
+	for day := range days {
+		keys = append(keys, day)
+	}
+	sort.Strings(keys)
+
+	client := s.Client
+	if client == nil {
+		client = s3.New(s.Session)
+	}
+
+	var errs []error
+	var failed []*Event
+	for _, day := range keys {
+		if err := s.upload(ctx, client, day, days[day]); err != nil {
+			errs = append(errs, err)
+			failed = append(failed, days[day]...)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &PartialError{
+			Failed: failed,
+			Err:    errors.Wrapf(errs[0], "%d of %d days failed", len(errs), len(keys)),
+		}
+	}
+
+	return nil
+}
+
+// upload the events that happened on `day` as one object.
+func (s *S3Sink) upload(ctx context.Context, client s3iface.S3API, day string, events []*Event) error {
+	body, err := gzipEvents(events)
+	if err != nil {
+		return errors.Wrap(err, "compressing events")
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return errors.Wrap(err, "generating key")
+	}
+
+	name := fmt.Sprintf("%d-%s.json.gz", time.Now().Unix(), id)
+	key := path.Join(s.Prefix, "dt="+day, name)
+
+	_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body),
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error uploading %s", key)
+	}
+
+	return nil
+}
+
+// partitionDay returns the YYYY-MM-DD day the event happened,
+// falling back to today if the timestamp can't be parsed.
+func partitionDay(event *Event) string {
+	t, err := parseTimestamp(event.Timestamp)
+	if err != nil {
+		t = time.Now()
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// gzip the events as newline-delimited JSON.
+func gzipEvents(events []*Event) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Segment limits each batch request to 500KB
+const segmentMaxBatch = 500 * 1024
+
+// SegmentSink sends events as Segment track calls to the
+// Segment HTTP API's batch endpoint.
+type SegmentSink struct {
+	WriteKey    string       // WriteKey of the Segment source
+	Endpoint    string       // Endpoint to post to. Defaults to https://api.segment.io/v1/batch
+	AnonymousID string       // AnonymousID for events without a user_id or anonymous_id (optional)
+	Client      *http.Client // Client used for requests. Defaults to http.DefaultClient
+}
+
+// segmentTrack is Segment's track payload.
+type segmentTrack struct {
+	Type        string                 `json:"type"`
+	MessageID   string                 `json:"messageId,omitempty"`
+	Event       string                 `json:"event"`
+	UserID      string                 `json:"userId,omitempty"`
+	AnonymousID string                 `json:"anonymousId,omitempty"`
+	Timestamp   string                 `json:"timestamp"`
+	Properties  map[string]interface{} `json:"properties"`
+}
+
+// Send the events to Segment.
+func (s *SegmentSink) Send(ctx context.Context, events []*Event) error {
+	if s.WriteKey == "" {
+		return fmt.Errorf("missing write key")
+	}
+
+	var batch []json.RawMessage
+	size := 0
+
+	for _, event := range events {
+		track := &segmentTrack{
+			Type:        "track",
+			MessageID:   event.ID,
+			Event:       event.Event,
+			UserID:      bodyString(event.Body, "user_id"),
+			AnonymousID: bodyString(event.Body, "anonymous_id"),
+			Timestamp:   isoTimestamp(event.Timestamp),
+			Properties:  event.Body,
+		}
+		if track.UserID == "" && track.AnonymousID == "" {
+			track.AnonymousID = s.AnonymousID
+		}
+
+		msg, err := json.Marshal(track)
+		if err != nil {
+			return errors.Wrapf(err, "marshal error")
+		}
+
+		// leave some room for the batch envelope
+		if len(batch) > 0 && size+len(msg) > segmentMaxBatch-1024 {
+			if err := s.post(ctx, batch); err != nil {
+				return err
+			}
+			batch, size = nil, 0
+		}
+
+		batch = append(batch, msg)
+		size += len(msg) + 1
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return s.post(ctx, batch)
+}
+
+// post a batch of track calls to Segment.
+func (s *SegmentSink) post(ctx context.Context, batch []json.RawMessage) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"batch": batch,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "marshal error")
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.segment.io/v1/batch"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(s.WriteKey, "")
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error sending batch to segment")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("segment responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SendMessageBatch accepts up to 10 messages per call
+	sqsMaxBatch = 10
+	// Messages and whole batches are limited to 256KB
+	sqsMaxBytes = 256 * 1024
+	// Leave room for the message attributes on split events
+	sqsMaxChunk = sqsMaxBytes - 1024
+)
+
+// SQSSink sends events to an SQS queue with SendMessageBatch.
+//
+// Events larger than the 256KB message limit are split into
+// several messages sharing a "group" attribute, along with
+// "part" and "parts" attributes to reassemble them.
+type SQSSink struct {
+	Session  *session.Session // Session credentials for AWS
+	Client   sqsiface.SQSAPI  // Client for SQS. Defaults to one created from Session
+	QueueURL string           // QueueURL we'll send to
+}
+
+// Send the events to SQS. Returns a *PartialError with the events
+// whose messages failed, so the ones that were sent aren't sent again.
+func (s *SQSSink) Send(ctx context.Context, events []*Event) error {
+	if s.QueueURL == "" {
+		return fmt.Errorf("missing queue url")
+	}
+
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var owners []int // owners are the index of each entry's event
+	for i, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrapf(err, "marshal error")
+		}
+
+		split, err := sqsEntries(body)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, split...)
+		for range split {
+			owners = append(owners, i)
+		}
+	}
+
+	client := s.Client
+	if client == nil {
+		client = sqs.New(s.Session)
+	}
+
+	var errs []error
+	failed := map[int]bool{}
+	for len(entries) > 0 {
+		n, size := 0, 0
+		for n < len(entries) && n < sqsMaxBatch {
+			size += len(*entries[n].MessageBody)
+			if n > 0 && size > sqsMaxBytes {
+				break
+			}
+			n++
+		}
+
+		batch, batchOwners := entries[:n], owners[:n]
+		entries, owners = entries[n:], owners[n:]
+
+		// entry ids only need to be unique within a batch
+		for i, entry := range batch {
+			entry.Id = aws.String(strconv.Itoa(i))
+		}
+
+		output, err := client.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(s.QueueURL),
+			Entries:  batch,
+		})
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "error sending messages to sqs"))
+			for _, i := range batchOwners {
+				failed[i] = true
+			}
+			continue
+		}
+
+		if len(output.Failed) > 0 {
+			errs = append(errs, fmt.Errorf("couldn't send %d of %d messages: %s", len(output.Failed), len(batch), aws.StringValue(output.Failed[0].Message)))
+		}
+		for _, entry := range output.Failed {
+			if i, err := strconv.Atoi(aws.StringValue(entry.Id)); err == nil && i < len(batchOwners) {
+				failed[batchOwners[i]] = true
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	// a split event is sent again whole if any of its parts failed
+	var retry []*Event
+	for i, event := range events {
+		if failed[i] {
+			retry = append(retry, event)
+		}
+	}
+
+	return &PartialError{
+		Failed: retry,
+		Err:    errs[0],
+	}
+}
+
+// sqsEntries turns an event into one or more batch entries,
+// splitting it if it's over the message size limit.
+func sqsEntries(body []byte) ([]*sqs.SendMessageBatchRequestEntry, error) {
+	if len(body) <= sqsMaxChunk {
+		return []*sqs.SendMessageBatchRequestEntry{
+			{MessageBody: aws.String(string(body))},
+		}, nil
+	}
+
+	group, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating group id")
+	}
+
+	// split on rune boundaries so each part is valid UTF-8
+	var chunks []string
+	for len(body) > 0 {
+		end := len(body)
+		if end > sqsMaxChunk {
+			end = sqsMaxChunk
+			for end > 0 && !utf8.RuneStart(body[end]) {
+				end--
+			}
+		}
+		chunks = append(chunks, string(body[:end]))
+		body = body[end:]
+	}
+
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(chunks))
+	for i, chunk := range chunks {
+		entries[i] = &sqs.SendMessageBatchRequestEntry{
+			MessageBody: aws.String(chunk),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"group": stringAttribute(group),
+				"part":  numberAttribute(i + 1),
+				"parts": numberAttribute(len(chunks)),
+			},
+		}
+	}
+
+	return entries, nil
+}
+
+func stringAttribute(s string) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(s),
+	}
+}
+
+func numberAttribute(n int) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(n)),
+	}
+}
@@ -0,0 +1,45 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// WriterSink writes events as pretty-printed JSON to stdout or a
+// local file, so you can verify instrumentation without AWS.
+type WriterSink struct {
+	Writer io.Writer // Writer we'll write to. Defaults to os.Stdout
+	Path   string    // Path of a file to append to instead (optional)
+}
+
+// Send writes the events out.
+func (s *WriterSink) Send(ctx context.Context, events []*Event) error {
+	w := s.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+
+	if s.Path != "" {
+		f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return errors.Wrap(err, "opening file")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return errors.Wrap(err, "writing event")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package analytics
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stats is a snapshot of the client's state, for diagnostics.
+type Stats struct {
+	Events    int       // Events queued
+	Bytes     int64     // Bytes queued, if the store knows
+	LastFlush time.Time // LastFlush that sent events, zero if there hasn't been one
+	LastError error     // LastError of the last flush, nil if it succeeded
+	Failures  int       // Failures of flushes in a row
+	Enabled   bool      // Enabled unless the user opted out
+	Lifecycle Lifecycle // Lifecycle of the client
+	Consent   Consent   // Consent the user has given
+	Dir       string    // Dir holding the config, like the id
+	StateDir  string    // StateDir holding the queue
+}
+
+// byteSizer is implemented by stores that know how many bytes
+// they're holding.
+type byteSizer interface {
+	Bytes() (int64, error)
+}
+
+// Stats returns a snapshot of the queue, the last flush and
+// whether tracking is enabled.
+func (a *Analytics) Stats() (Stats, error) {
+	a.mu.Lock()
+	stats := Stats{
+		LastError: a.flushErr,
+		Failures:  a.failures,
+		Enabled:   a.consent != ConsentOff,
+		Lifecycle: a.lifecycle,
+		Consent:   a.consent,
+	}
+	a.mu.Unlock()
+
+	if !a.Memory {
+		stats.Dir = a.root
+		stats.StateDir = a.stateRoot
+	}
+
+	n, err := a.Size()
+	if err != nil {
+		return stats, err
+	}
+	stats.Events = n
+
+	if s, ok := a.store.(byteSizer); ok {
+		if stats.Bytes, err = s.Bytes(); err != nil {
+			return stats, errors.Wrap(err, "sizing events")
+		}
+	}
+
+	last, err := a.modTime("last_flush")
+	if err == nil {
+		stats.LastFlush = last
+	} else if !os.IsNotExist(err) {
+		return stats, errors.Wrap(err, "reading last flush")
+	}
+
+	return stats, nil
+}
+
+// record the result of a flush for Stats.
+func (a *Analytics) record(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.flushErr = err
+	if err != nil {
+		a.failures++
+	} else {
+		a.failures = 0
+	}
+}
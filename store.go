@@ -0,0 +1,903 @@
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// Store is the local queue of events waiting to be flushed.
+type Store interface {
+	// Append events to the end of the queue.
+	Append(events ...*Event) error
+	// ReadBatch reads up to n events from the front of the queue,
+	// without removing them. Reads every event if n <= 0.
+	ReadBatch(n int) ([]*Event, error)
+	// Remove n events from the front of the queue.
+	Remove(n int) error
+	// Size returns the number of queued events.
+	Size() (int, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// locker is implemented by stores shared between processes, so a
+// flush can hold the lock from reading the events until removing them.
+type locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// excluder is implemented by stores shared between processes, so files
+// kept alongside them can be read and written without interleaving.
+type excluder interface {
+	exclusive(fn func() error) error
+}
+
+// syncer is implemented by stores that buffer writes, so they can be
+// flushed to disk on demand.
+type syncer interface {
+	Sync() error
+}
+
+// streamer is implemented by stores that keep their queue in segments,
+// so a flush can send them one at a time, a batch at a time.
+type streamer interface {
+	// Stream passes the events in the oldest segment to fn in batches,
+	// returning how many it read.
+	Stream(fn func([]*Event) error) (int, error)
+}
+
+// flock is an advisory lock on a file, shared between processes.
+type flock struct {
+	path  string
+	mode  os.FileMode
+	file  *os.File // opened on the first lock
+	depth int      // lock depth within this process
+}
+
+// lock blocks until other processes release the lock. There's nothing
+// to lock until the directory's created by the first write.
+func (l *flock) lock() error {
+	if l.depth > 0 {
+		l.depth++
+		return nil
+	}
+
+	if err := l.open(); os.IsNotExist(errors.Cause(err)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := lockFile(l.file); err != nil {
+		return errors.Wrap(err, "locking")
+	}
+
+	l.depth = 1
+	return nil
+}
+
+// tryLock takes the lock if no other process holds it.
+func (l *flock) tryLock() (bool, error) {
+	if l.depth > 0 {
+		l.depth++
+		return true, nil
+	}
+
+	if err := l.open(); os.IsNotExist(errors.Cause(err)) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	ok, err := tryLockFile(l.file)
+	if err != nil {
+		return false, errors.Wrap(err, "locking")
+	} else if !ok {
+		return false, nil
+	}
+
+	l.depth = 1
+	return true, nil
+}
+
+// open the lock file.
+func (l *flock) open() error {
+	if l.file != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, l.mode)
+	if err != nil {
+		return errors.Wrap(err, "opening lock")
+	}
+
+	l.file = f
+	return nil
+}
+
+// unlock releases the lock.
+func (l *flock) unlock() error {
+	if l.depth == 0 {
+		return nil
+	}
+
+	l.depth--
+	if l.depth > 0 {
+		return nil
+	}
+
+	return unlockFile(l.file)
+}
+
+// close the lock file, releasing the lock.
+func (l *flock) close() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	l.depth = 0
+	return err
+}
+
+// segmentSize is the default size at which the events file is rotated.
+const segmentSize = 8 << 20
+
+// fileStore queues newline-delimited JSON events in ~/<dir>/events.
+// Flushing, or the file growing past the segment size, rotates the
+// events into numbered segments, e.g. ~/<dir>/events.1, which are
+// only removed once they've been sent.
+// Appends are serialized between processes with ~/<dir>/events.lock
+// and flushes with ~/<dir>/events.flush.lock, so appending never
+// waits on a flush that's sending. Goroutines are serialized in-process,
+// since they share the file locks.
+type fileStore struct {
+	mu        sync.Mutex
+	path      string
+	mode      os.FileMode    // mode of the files we create
+	size      int64          // size at which the file is rotated
+	maxBytes  int64          // maximum size of the queue in bytes
+	maxEvents int            // maximum number of queued events
+	evict     EvictionPolicy // evict policy once the queue is full
+	compress  bool           // compress segments with gzip
+	aead      cipher.AEAD    // aead encrypts each event, if set
+	corrupt   string         // corrupt is where unreadable events are moved, if set
+	syncEvery int            // syncEvery fsyncs after this many events, if set
+	metrics   Metrics        // metrics counts the evicted events
+	unsynced  int            // unsynced events since the last fsync
+	bufSize   int            // bufSize buffers appends up to this many bytes, if set
+	buf       []byte         // buf holds the records not yet written
+	buffered  int            // buffered events in buf
+	log       log.Interface
+	file      *os.File // opened on the first append
+	lock      *flock
+	flush     *flock
+	counts    map[string]*lineCount // cached event counts by file
+}
+
+// newFileStore queues events in the file at `path`, creating
+// files with `mode`.
+func newFileStore(path string, mode os.FileMode) *fileStore {
+	return &fileStore{
+		path:    path,
+		mode:    mode,
+		log:     log.Log,
+		metrics: nopMetrics{},
+		lock:    &flock{path: path + ".lock", mode: mode},
+		flush:   &flock{path: path + ".flush.lock", mode: mode},
+		counts:  map[string]*lineCount{},
+	}
+}
+
+// Lock the store for flushing, rotating the events so far into a
+// segment. Events appended while flushing go to a new file.
+func (s *fileStore) Lock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush.lock(); err != nil {
+		return err
+	}
+
+	if err := s.rotate(); err != nil {
+		s.flush.unlock()
+		return errors.Wrap(err, "rotating")
+	}
+
+	if s.compress {
+		if err := s.compressSegments(); err != nil {
+			s.flush.unlock()
+			return errors.Wrap(err, "compressing")
+		}
+	}
+
+	return nil
+}
+
+// Unlock the store after flushing.
+func (s *fileStore) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush.unlock()
+}
+
+// exclusive runs fn holding the lock appends take, so other processes
+// wait until it's done. Appends within fn don't wait on it.
+func (s *fileStore) exclusive(fn func() error) error {
+	s.mu.Lock()
+	err := s.lock.lock()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		s.mu.Lock()
+		s.lock.unlock()
+		s.mu.Unlock()
+	}()
+
+	return fn()
+}
+
+// rotate renames the events file to the next segment.
+func (s *fileStore) rotate() error {
+	if err := s.lock.lock(); err != nil {
+		return err
+	}
+	defer s.lock.unlock()
+
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(segments) > 0 {
+		next = s.number(segments[len(segments)-1]) + 1
+	}
+
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+
+	return os.Rename(s.path, s.segment(next))
+}
+
+// segments returns the paths to the segments, oldest first. Compressed
+// segments replace their uncompressed originals.
+func (s *fileStore) segments() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(s.path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	byNumber := map[int]string{}
+	var numbers []int
+
+	for _, entry := range entries {
+		path := filepath.Join(filepath.Dir(s.path), entry.Name())
+
+		n := s.number(path)
+		if n == 0 {
+			continue
+		}
+
+		if _, ok := byNumber[n]; !ok {
+			numbers = append(numbers, n)
+		}
+
+		if byNumber[n] == "" || compressed(path) {
+			byNumber[n] = path
+		}
+	}
+
+	sort.Ints(numbers)
+
+	segments := make([]string, len(numbers))
+	for i, n := range numbers {
+		segments[i] = byNumber[n]
+	}
+
+	return segments, nil
+}
+
+// segment returns the path to segment `n`.
+func (s *fileStore) segment(n int) string {
+	return s.path + "." + strconv.Itoa(n)
+}
+
+// number returns the segment's number, or 0 if it's not a segment.
+func (s *fileStore) number(path string) int {
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	prefix := filepath.Base(s.path) + "."
+
+	if !strings.HasPrefix(name, prefix) {
+		return 0
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	if err != nil || n < 1 {
+		return 0
+	}
+
+	return n
+}
+
+// Stream decodes the events in the oldest segment a batch at a time,
+// so a large backlog is never loaded into memory at once. Returns how
+// many events it read, stopping at the first error from fn. Events that
+// haven't been rotated into a segment yet are left for the next flush.
+func (s *fileStore) Stream(fn func([]*Event) error) (int, error) {
+	s.mu.Lock()
+	segments, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, errors.Wrap(err, "listing segments")
+	}
+
+	for _, segment := range segments {
+		n, err := s.streamEvents(segment, fn)
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+
+	return 0, nil
+}
+
+// Append the events to the file.
+func (s *fileStore) Append(events ...*Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.lock.lock(); err != nil {
+		return err
+	}
+	defer s.lock.unlock()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	for _, event := range events {
+		if err := s.encode(buf, event); err != nil {
+			return err
+		}
+	}
+	records := buf.Bytes()
+
+	if ok, err := s.makeRoom(int64(len(records)), len(events)); err != nil {
+		return errors.Wrap(err, "evicting events")
+	} else if !ok {
+		return nil
+	}
+
+	// records are buffered whole, so they're still written in one call
+	if s.bufSize > 0 && len(s.buf)+len(records) > s.bufSize {
+		if err := s.flushBuffer(); err != nil {
+			return err
+		}
+	}
+
+	if s.bufSize > 0 && len(records) <= s.bufSize {
+		s.buf = append(s.buf, records...)
+		s.buffered += len(events)
+	} else if err := s.write(records, len(events)); err != nil {
+		return err
+	}
+
+	if s.size <= 0 || s.file == nil {
+		return nil
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat events")
+	}
+
+	if info.Size() < s.size {
+		return nil
+	}
+
+	if err := s.rotate(); err != nil {
+		return errors.Wrap(err, "rotating")
+	}
+
+	if !s.compress {
+		return nil
+	}
+
+	// compress now unless a flush is in progress, otherwise
+	// the next flush will
+	ok, err := s.flush.tryLock()
+	if err != nil || !ok {
+		return err
+	}
+	defer s.flush.unlock()
+
+	return s.compressSegments()
+}
+
+// write the records to the events file in a single call, while
+// holding the lock.
+func (s *fileStore) write(records []byte, events int) error {
+	// another process may have replaced the file since we opened it
+	if s.file != nil {
+		a, err1 := s.file.Stat()
+		b, err2 := os.Stat(s.path)
+		if err1 != nil || err2 != nil || !os.SameFile(a, b) {
+			s.release()
+		}
+	}
+
+	if s.file == nil {
+		f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, s.mode)
+		if err != nil {
+			return errors.Wrap(err, "opening events")
+		}
+		s.file = f
+
+		// end a line cut short by a crash, so it doesn't swallow the next event
+		if err := terminate(f); err != nil {
+			return errors.Wrap(err, "repairing events")
+		}
+	}
+
+	if _, err := s.file.Write(records); err != nil {
+		return errors.Wrap(err, "writing event")
+	}
+
+	s.unsynced += events
+	if s.syncEvery > 0 && s.unsynced >= s.syncEvery {
+		return s.sync()
+	}
+
+	return nil
+}
+
+// flushBuffer writes the buffered records while holding the lock.
+func (s *fileStore) flushBuffer() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	if err := s.write(s.buf, s.buffered); err != nil {
+		return err
+	}
+
+	s.buf = s.buf[:0]
+	s.buffered = 0
+	return nil
+}
+
+// Sync writes the buffered events and flushes the events file to disk.
+func (s *fileStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.lock.lock(); err != nil {
+		return err
+	}
+	defer s.lock.unlock()
+
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+
+	if s.file == nil {
+		return nil
+	}
+
+	return s.sync()
+}
+
+// ReadBatch reads up to n events from the segments, then the
+// events file.
+func (s *fileStore) ReadBatch(n int) (v []*Event, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing segments")
+	}
+
+	for _, segment := range segments {
+		if n > 0 && len(v) >= n {
+			return v, nil
+		}
+
+		// a flush in another process may have just removed it
+		events, err := s.readEvents(segment, n-len(v))
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, events...)
+	}
+
+	if n > 0 && len(v) >= n {
+		return v, nil
+	}
+
+	if err := s.lock.lock(); err != nil {
+		return nil, err
+	}
+	defer s.lock.unlock()
+
+	if err := s.flushBuffer(); err != nil {
+		return nil, err
+	}
+
+	events, err := s.readEvents(s.path, n-len(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(v, events...), nil
+}
+
+// Remove the first n events, removing the segments they were in.
+func (s *fileStore) Remove(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush.lock(); err != nil {
+		return err
+	}
+	defer s.flush.unlock()
+
+	return s.remove(n)
+}
+
+// remove the first n events while holding the flush lock.
+func (s *fileStore) remove(n int) error {
+	segments, err := s.segments()
+	if err != nil {
+		return errors.Wrap(err, "listing segments")
+	}
+
+	for _, segment := range segments {
+		if n <= 0 {
+			return nil
+		}
+
+		removed, err := s.removeEvents(segment, n)
+		if err != nil {
+			return err
+		}
+		n -= removed
+	}
+
+	if n <= 0 {
+		return nil
+	}
+
+	if err := s.lock.lock(); err != nil {
+		return err
+	}
+	defer s.lock.unlock()
+
+	// appends need to go to the new file
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+
+	_, err = s.removeEvents(s.path, n)
+	return err
+}
+
+// Size returns the number of events in the files, counting their lines
+// rather than decoding them. Counts are cached until a file changes.
+func (s *fileStore) Size() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.lock.lock(); err != nil {
+		return 0, err
+	}
+	defer s.lock.unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return 0, errors.Wrap(err, "listing segments")
+	}
+
+	n := 0
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		count, err := s.count(path, info)
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+
+	return n + s.buffered, nil
+}
+
+// Bytes returns the size of the files, plus any buffered records.
+func (s *fileStore) Bytes() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return 0, errors.Wrap(err, "listing segments")
+	}
+
+	n := int64(len(s.buf))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		n += info.Size()
+	}
+
+	return n, nil
+}
+
+// Close the files.
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.file != nil || len(s.buf) > 0 {
+		if err = s.lock.lock(); err == nil {
+			err = s.closeFile()
+			s.lock.unlock()
+		}
+	}
+
+	s.lock.close()
+	s.flush.close()
+	return err
+}
+
+// terminate adds a newline to the file if it doesn't end with one.
+func terminate(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+
+	if last[0] == '\n' {
+		return nil
+	}
+
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+// fsync the file to disk, replaced in tests to count them.
+var fsync = (*os.File).Sync
+
+// sync flushes the appended events to disk.
+func (s *fileStore) sync() error {
+	if err := fsync(s.file); err != nil {
+		return errors.Wrap(err, "syncing events")
+	}
+
+	s.unsynced = 0
+	return nil
+}
+
+// closeFile writes the buffered records and closes the append handle,
+// while holding the lock.
+func (s *fileStore) closeFile() error {
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+
+	return s.release()
+}
+
+// release closes the append handle, syncing it first when running
+// in durable mode.
+func (s *fileStore) release() error {
+	if s.file == nil {
+		return nil
+	}
+
+	if s.syncEvery > 0 && s.unsynced > 0 {
+		if err := s.sync(); err != nil {
+			s.file.Close()
+			s.file = nil
+			return err
+		}
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// readEvents reads up to n events from the file at `path`.
+func (s *fileStore) readEvents(path string, n int) (v []*Event, err error) {
+	f, err := openEvents(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "opening")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	for n <= 0 || len(v) < n {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e, err := s.decode(line)
+			if err != nil {
+				s.log.WithError(err).Debug("skipping corrupt event")
+			} else {
+				v = append(v, e)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "reading")
+		}
+	}
+
+	return v, nil
+}
+
+// streamEvents decodes the events in the file at `path`, passing them
+// to fn in batches of up to a Firehose batch.
+func (s *fileStore) streamEvents(path string, fn func([]*Event) error) (int, error) {
+	f, err := openEvents(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "opening")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var batch []*Event
+	n := 0
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e, err := s.decode(line)
+			if err != nil {
+				s.log.WithError(err).Debug("skipping corrupt event")
+			} else {
+				batch = append(batch, e)
+				n++
+			}
+		}
+
+		if len(batch) == firehoseMaxRecords || (err == io.EOF && len(batch) > 0) {
+			if err := fn(batch); err != nil {
+				return n, err
+			}
+			batch = nil
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, errors.Wrap(err, "reading")
+		}
+	}
+
+	return n, nil
+}
+
+// removeEvents removes up to n events from the front of the file at
+// `path`, rewriting the rest to a new file. Returns the number removed.
+// Corrupt lines before the n-th event are removed too, moving them to
+// ~/<dir>/corrupt when keeping them.
+func (s *fileStore) removeEvents(path string, n int) (int, error) {
+	f, err := openEvents(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "opening")
+	}
+
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "reading")
+	}
+
+	var corrupt, rest []byte
+	removed := 0
+
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		switch {
+		case len(bytes.TrimSpace(line)) == 0:
+			continue
+		case removed == n:
+			rest = append(rest, line...)
+		case s.valid(line):
+			removed++
+		default:
+			corrupt = append(corrupt, line...)
+		}
+	}
+
+	if len(corrupt) > 0 && s.corrupt != "" {
+		if err := appendFile(s.corrupt, corrupt, s.mode); err != nil {
+			return 0, errors.Wrap(err, "saving corrupt events")
+		}
+	}
+
+	if len(rest) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return removed, nil
+	}
+
+	return removed, writeEvents(path, rest, s.mode)
+}
+
+// valid returns true if the line decodes to an event.
+func (s *fileStore) valid(line []byte) bool {
+	_, err := s.decode(line)
+	return err == nil
+}
+
+// appendFile appends `data` to the file at `path`.
+func appendFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
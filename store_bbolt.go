@@ -0,0 +1,121 @@
+//go:build bbolt
+// +build bbolt
+
+package analytics
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("events")
+
+// BoltStore queues events in a single transactional bbolt database,
+// so appends and flushes can't corrupt each other. It's only available
+// when building with `-tags bbolt`.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the database at `path`. The database
+// is locked while open, so other processes wait up to a second for it.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "opening database")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating bucket")
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Append the events in a single transaction.
+func (s *BoltStore) Append(events ...*Event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return errors.Wrap(err, "marshal error")
+			}
+
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			// big-endian keys iterate in insertion order
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+
+			if err := b.Put(key, data); err != nil {
+				return errors.Wrap(err, "writing event")
+			}
+		}
+
+		return nil
+	})
+}
+
+// ReadBatch reads up to n of the oldest events.
+func (s *BoltStore) ReadBatch(n int) (events []*Event, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+
+		for k, v := c.First(); k != nil && (n <= 0 || len(events) < n); k, v = c.Next() {
+			var e Event
+			if err := json.Unmarshal(v, &e); err != nil {
+				return errors.Wrap(err, "decoding")
+			}
+			events = append(events, &e)
+		}
+
+		return nil
+	})
+
+	return events, err
+}
+
+// Remove the n oldest events.
+func (s *BoltStore) Remove(n int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+
+		for k, _ := c.First(); k != nil && n > 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return errors.Wrap(err, "deleting event")
+			}
+			n--
+		}
+
+		return nil
+	})
+}
+
+// Size returns the number of queued events.
+func (s *BoltStore) Size() (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltBucket).Stats().KeyN
+		return nil
+	})
+
+	return n, err
+}
+
+// Close the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
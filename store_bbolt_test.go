@@ -0,0 +1,18 @@
+//go:build bbolt
+// +build bbolt
+
+package analytics_test
+
+import (
+	"testing"
+
+	"github.com/matthewmueller/firehose-analytics"
+)
+
+func TestBoltStore(t *testing.T) {
+	store, err := analytics.NewBoltStore(t.TempDir() + "/events.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
@@ -0,0 +1,58 @@
+package analytics
+
+import "sync"
+
+// MemoryStore queues events in memory. Queued events are lost when the
+// process exits, which suits tests and short-lived processes.
+type MemoryStore struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+// Append the events.
+func (s *MemoryStore) Append(events ...*Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+// ReadBatch reads up to n of the oldest events.
+func (s *MemoryStore) ReadBatch(n int) ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n <= 0 || n > len(s.events) {
+		n = len(s.events)
+	}
+
+	events := make([]*Event, n)
+	copy(events, s.events)
+	return events, nil
+}
+
+// Remove the n oldest events.
+func (s *MemoryStore) Remove(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.events) {
+		n = len(s.events)
+	}
+
+	s.events = append([]*Event(nil), s.events[n:]...)
+	return nil
+}
+
+// Size returns the number of queued events.
+func (s *MemoryStore) Size() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.events), nil
+}
+
+// Close is a no-op, events stay queued until they're removed.
+func (s *MemoryStore) Close() error {
+	return nil
+}
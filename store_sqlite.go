@@ -0,0 +1,146 @@
+//go:build sqlite
+// +build sqlite
+
+package analytics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite" // pure go driver, no cgo
+)
+
+const sqliteSchema = `
+create table if not exists events (
+	pos integer primary key autoincrement,
+	ts text not null,
+	name text not null,
+	data text not null
+);
+create index if not exists events_ts on events (ts);
+create index if not exists events_name on events (name, ts);
+`
+
+// SQLiteStore queues events in a SQLite database, giving atomic appends
+// and safe concurrent access from multiple processes. It's only
+// available when building with `-tags sqlite`.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens or creates the database at `path`.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening database")
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating schema")
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// Append the events in a single transaction.
+func (s *SQLiteStore) Append(events ...*Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`insert into events (ts, name, data) values (?, ?, ?)`)
+	if err != nil {
+		return errors.Wrap(err, "preparing insert")
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrap(err, "marshal error")
+		}
+
+		if _, err := stmt.Exec(event.Timestamp, event.Event, string(data)); err != nil {
+			return errors.Wrap(err, "inserting event")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReadBatch reads up to n of the oldest events.
+func (s *SQLiteStore) ReadBatch(n int) ([]*Event, error) {
+	if n <= 0 {
+		n = -1 // no limit
+	}
+
+	return s.query(`select data from events order by pos limit ?`, n)
+}
+
+// Query the events named `name` that happened at or after `since`.
+// An empty name matches every event.
+func (s *SQLiteStore) Query(name string, since time.Time) ([]*Event, error) {
+	ts := since.UTC().Format(time.RFC3339)
+
+	if name == "" {
+		return s.query(`select data from events where ts >= ? order by pos`, ts)
+	}
+
+	return s.query(`select data from events where name = ? and ts >= ? order by pos`, name, ts)
+}
+
+func (s *SQLiteStore) query(query string, args ...interface{}) ([]*Event, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying events")
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, errors.Wrap(err, "scanning event")
+		}
+
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, errors.Wrap(err, "decoding")
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, rows.Err()
+}
+
+// Remove the n oldest events.
+func (s *SQLiteStore) Remove(n int) error {
+	_, err := s.db.Exec(`delete from events where pos in (select pos from events order by pos limit ?)`, n)
+	if err != nil {
+		return errors.Wrap(err, "deleting events")
+	}
+
+	return nil
+}
+
+// Size returns the number of queued events.
+func (s *SQLiteStore) Size() (n int, err error) {
+	if err := s.db.QueryRow(`select count(*) from events`).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "counting events")
+	}
+
+	return n, nil
+}
+
+// Close the database.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,46 @@
+//go:build sqlite
+// +build sqlite
+
+package analytics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matthewmueller/firehose-analytics"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := analytics.NewSQLiteStore(t.TempDir() + "/events.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+func TestSQLiteQuery(t *testing.T) {
+	store, err := analytics.NewSQLiteStore(t.TempDir() + "/events.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	store.Append(
+		&analytics.Event{Event: "a", Timestamp: day.Format(time.RFC3339)},
+		&analytics.Event{Event: "b", Timestamp: day.Add(time.Hour).Format(time.RFC3339)},
+		&analytics.Event{Event: "a", Timestamp: day.Add(2 * time.Hour).Format(time.RFC3339)},
+	)
+
+	events, err := store.Query("a", day.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Timestamp != day.Add(2*time.Hour).Format(time.RFC3339) {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	if events, _ := store.Query("", day); len(events) != 3 {
+		t.Fatalf("expected every event, got %d", len(events))
+	}
+}
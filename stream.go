@@ -0,0 +1,124 @@
+package analytics
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/pkg/errors"
+)
+
+// how often to check if a new stream is active
+const streamPollInterval = 5 * time.Second
+
+// ensureStream checks that the delivery stream exists, creating it
+// from the S3 destination template if it doesn't. It waits for a
+// new stream to become active before returning.
+func (s *FirehoseSink) ensureStream(ctx context.Context, fh firehoseiface.FirehoseAPI) error {
+	status, err := streamStatus(ctx, fh, s.Stream)
+	if err != nil {
+		return err
+	}
+
+	if status == "" {
+		if s.S3Destination == nil {
+			return errors.Errorf("stream %q doesn't exist and there's no S3 destination to create it with", s.Stream)
+		}
+
+		_, err := fh.CreateDeliveryStreamWithContext(ctx, &firehose.CreateDeliveryStreamInput{
+			DeliveryStreamName:                 aws.String(s.Stream),
+			DeliveryStreamType:                 aws.String(firehose.DeliveryStreamTypeDirectPut),
+			ExtendedS3DestinationConfiguration: s.S3Destination,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "creating stream %q", s.Stream)
+		}
+
+		status, err = streamStatus(ctx, fh, s.Stream)
+		if err != nil {
+			return err
+		}
+	}
+
+	for status == firehose.DeliveryStreamStatusCreating {
+		if err := sleep(ctx, streamPollInterval); err != nil {
+			return errors.Wrap(err, "waiting for stream")
+		}
+
+		status, err = streamStatus(ctx, fh, s.Stream)
+		if err != nil {
+			return err
+		}
+	}
+
+	if status != firehose.DeliveryStreamStatusActive {
+		return errors.Errorf("stream %q is %s", s.Stream, status)
+	}
+
+	return nil
+}
+
+// Ping checks that the credentials can describe the delivery stream
+// and that it's active, without sending any events.
+func (s *FirehoseSink) Ping(ctx context.Context) error {
+	if s.Stream == "" {
+		return errors.New("missing stream name")
+	}
+
+	status, err := streamStatus(ctx, s.client(), s.Stream)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case "":
+		return errors.Errorf("stream %q doesn't exist", s.Stream)
+	case firehose.DeliveryStreamStatusActive:
+		return nil
+	default:
+		return errors.Errorf("stream %q is %s", s.Stream, status)
+	}
+}
+
+// pinger is implemented by sinks that can check they're reachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks that the sink is configured and reachable without sending
+// any events, so applications can warn about misconfigured telemetry
+// early. Sinks that can't be checked are assumed to be fine.
+func (a *Analytics) Ping(ctx context.Context) error {
+	if a.Sink == nil {
+		return errors.New("no sink")
+	}
+
+	p, ok := a.Sink.(pinger)
+	if !ok {
+		return nil
+	}
+
+	if err := p.Ping(ctx); err != nil {
+		return errors.Wrap(err, "pinging")
+	}
+
+	return nil
+}
+
+// streamStatus returns the status of the stream, or an empty
+// string if the stream doesn't exist.
+func streamStatus(ctx context.Context, fh firehoseiface.FirehoseAPI, stream string) (string, error) {
+	output, err := fh.DescribeDeliveryStreamWithContext(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(stream),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == firehose.ErrCodeResourceNotFoundException {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "describing stream %q", stream)
+	}
+
+	return aws.StringValue(output.DeliveryStreamDescription.DeliveryStreamStatus), nil
+}
@@ -0,0 +1,32 @@
+package analytics
+
+import "time"
+
+// Timer measures how long an operation takes.
+type Timer struct {
+	a     *Analytics
+	name  string
+	start time.Time
+}
+
+// StartTimer starts timing event `name`. Call Stop to track it.
+func (a *Analytics) StartTimer(name string) *Timer {
+	return &Timer{
+		a:     a,
+		name:  name,
+		start: time.Now(),
+	}
+}
+
+// Stop the timer, tracking the event with optional `body`
+// and the elapsed time in `duration_ms`.
+func (t *Timer) Stop(body Body) error {
+	if body == nil {
+		body = Body{}
+	}
+
+	elapsed := time.Since(t.start)
+	body.Set("duration_ms", elapsed.Nanoseconds()/int64(time.Millisecond))
+
+	return t.a.Track(t.name, body)
+}
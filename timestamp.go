@@ -0,0 +1,49 @@
+package analytics
+
+import (
+	"strconv"
+	"time"
+)
+
+// TimestampFormat of the events' timestamps. Events tracked within the
+// same second can also be ordered by their seq.
+type TimestampFormat int
+
+// Timestamp formats
+const (
+	TimestampSeconds TimestampFormat = iota // RFC3339 at second precision
+	TimestampNano                           // RFC3339 with nanoseconds
+	TimestampMillis                         // Milliseconds since the Unix epoch
+)
+
+// format `t` in UTC.
+func (f TimestampFormat) format(t time.Time) string {
+	switch f {
+	case TimestampNano:
+		return t.UTC().Format(time.RFC3339Nano)
+	case TimestampMillis:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	default:
+		return t.UTC().Format(time.RFC3339)
+	}
+}
+
+// parseTimestamp parses a timestamp in any of the formats.
+func parseTimestamp(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// isoTimestamp returns the timestamp as RFC3339, for sinks that
+// don't accept epoch milliseconds.
+func isoTimestamp(s string) string {
+	t, err := parseTimestamp(s)
+	if err != nil {
+		return s
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
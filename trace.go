@@ -0,0 +1,31 @@
+package analytics
+
+import "context"
+
+// Tracer starts spans around flushing, so its latency shows up in
+// distributed traces. Build with `-tags otel` for OpenTelemetry.
+type Tracer interface {
+	// Start a span named `name`, returning a context carrying it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is the work started by a Tracer.
+type Span interface {
+	// Set an attribute on the span.
+	Set(key string, value interface{})
+	// End the span, recording err if it failed.
+	End(err error)
+}
+
+// nopTracer doesn't trace.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// nopSpan is started by nopTracer.
+type nopSpan struct{}
+
+func (nopSpan) Set(string, interface{}) {}
+func (nopSpan) End(error)               {}
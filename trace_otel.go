@@ -0,0 +1,62 @@
+//go:build otel
+// +build otel
+
+package analytics
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry returns a Tracer that starts spans from `tp`. It's only
+// available when building with `-tags otel`.
+func OpenTelemetry(tp trace.TracerProvider) Tracer {
+	return &otelTracer{tp.Tracer("github.com/matthewmueller/firehose-analytics")}
+}
+
+// otelTracer starts OpenTelemetry spans.
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+// Start implements Tracer.
+func (t *otelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &otelSpan{span}
+}
+
+// otelSpan is an OpenTelemetry span.
+type otelSpan struct {
+	span trace.Span
+}
+
+// Set implements Span.
+func (s *otelSpan) Set(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case float64:
+		s.span.SetAttributes(attribute.Float64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// End implements Span.
+func (s *otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,49 @@
+package analytics
+
+import (
+	"runtime/debug"
+)
+
+// module path of this library
+const modulePath = "github.com/matthewmueller/firehose-analytics"
+
+// libVersion is the version of this library the app was built with.
+var libVersion = readLibVersion()
+
+// readLibVersion reads the library's version from the build info,
+// falling back to "(devel)" for local builds.
+func readLibVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+
+	if info.Main.Path == modulePath && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path != modulePath {
+			continue
+		}
+
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+
+		return dep.Version
+	}
+
+	return "(devel)"
+}
+
+// attach the app and library versions to the body.
+func (a *Analytics) attachVersion(body Body) {
+	if a.Version != "" && body["app_version"] == nil {
+		body.Set("app_version", a.Version)
+	}
+
+	if body["analytics_lib_version"] == nil {
+		body.Set("analytics_lib_version", libVersion)
+	}
+}